@@ -53,6 +53,32 @@ namespace LiventCord.Controllers
             return Ok(new { guildId, channels });
         }
 
+        [Authorize]
+        [HttpGet("/api/v1/guilds/{guildId}/channels/{channelId}/viewers")]
+        public async Task<IActionResult> HandleGetChannelViewers(
+            [FromRoute][IdLengthValidation] string guildId,
+            [FromRoute][IdLengthValidation] string channelId
+        )
+        {
+            if (!await _dbContext.DoesMemberExistInGuild(UserId!, guildId))
+                return NotFound();
+
+            var exists = await _dbContext.Channels.AnyAsync(c =>
+                c.ChannelId == channelId && c.GuildId == guildId
+            );
+            if (!exists)
+                return NotFound();
+
+            var readers = await _permissionsController.GetUsersWithPermission(
+                guildId,
+                PermissionFlags.ReadMessages
+            );
+            var members = await _dbContext.GetGuildUserIds(guildId, null);
+            var userIds = members.Where(readers.Contains).ToList();
+
+            return Ok(new { guildId, channelId, userIds });
+        }
+
         [Authorize]
         [HttpDelete("/api/v1/guilds/{guildId}/channels/{channelId}")]
         public async Task<IActionResult> DeleteChannel(
@@ -65,6 +65,30 @@ namespace LiventCord.Controllers
         public async Task<bool> IsUserAdmin(string userId, string guildId) =>
             await CheckPermission(userId, guildId, PermissionFlags.IsAdmin);
 
+        [NonAction]
+        public async Task<List<string>> GetUsersWithPermission(
+            string guildId,
+            PermissionFlags permission
+        )
+        {
+            var ownerId = await GetGuildOwner(guildId);
+            var granted = await _dbContext
+                .GuildPermissions.Where(gp => gp.GuildId == guildId)
+                .Select(gp => new { gp.UserId, gp.Permissions })
+                .ToListAsync();
+
+            var userIds = granted
+                .Where(gp =>
+                    gp.Permissions.HasFlag(PermissionFlags.IsAdmin)
+                    || gp.Permissions.HasFlag(PermissionFlags.All)
+                    || gp.Permissions.HasFlag(permission)
+                )
+                .Select(gp => gp.UserId)
+                .ToHashSet();
+            userIds.Add(ownerId);
+            return userIds.ToList();
+        }
+
         private async Task<string> GetGuildOwner(string guildId)
         {
             var guild = await _dbContext.Guilds.FirstOrDefaultAsync(g => g.GuildId == guildId);
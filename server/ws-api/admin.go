@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admin routes give moderators a view of the gateway and a few levers to pull
+// during incidents. They sit behind AdminAuthMiddleware next to /health.
+// Listings cover the node that answers; in cluster mode they also name the
+// users the other nodes hold. Disconnects and "everyone" announcements are
+// relayed to the other nodes over the cluster channel.
+
+const (
+	closeAdminDisconnect = 4011
+
+	systemAnnouncementEvent = "SYSTEM_ANNOUNCEMENT"
+
+	adminActionDisconnect = "disconnect"
+	adminActionAnnounce   = "announce"
+	adminActionRevoke     = "revoke"
+)
+
+type AdminConnection struct {
+	SessionId    string               `json:"sessionId,omitempty"`
+	Platform     string               `json:"platform"`
+	Version      string               `json:"clientVersion,omitempty"`
+	Codec        string               `json:"codec"`
+	PingRttMs    int64                `json:"pingRttMs"`
+	LastActivity int64                `json:"lastActivity"`
+	Queue        ConnectionQueueStats `json:"queue"`
+	Compression  CompressionStats     `json:"compression"`
+	Subscribed   *SubscribePayload    `json:"subscriptions,omitempty"`
+}
+
+type AdminUser struct {
+	UserId           string            `json:"userId"`
+	Connections      []AdminConnection `json:"connections"`
+	DetachedSessions []string          `json:"detachedSessions"`
+	InVoice          bool              `json:"inVoice"`
+}
+
+type AdminUsersResponse struct {
+	NodeId     string              `json:"nodeId"`
+	Users      []AdminUser         `json:"users"`
+	OtherNodes map[string][]string `json:"otherNodes,omitempty"`
+}
+
+type AdminVoiceParticipant struct {
+	UserId       string `json:"userId"`
+	IsNoisy      bool   `json:"isNoisy"`
+	IsMuted      bool   `json:"isMuted"`
+	IsDeafened   bool   `json:"isDeafened"`
+	LastActivity int64  `json:"lastActivity"`
+}
+
+type AdminVoiceRoom struct {
+	RoomId       string                  `json:"roomId"`
+	Participants []AdminVoiceParticipant `json:"participants"`
+}
+
+type AdminDisconnectRequest struct {
+	SessionId    string `json:"sessionId"`
+	IncludeVoice bool   `json:"includeVoice"`
+	Reason       string `json:"reason"`
+}
+
+type AnnouncementRequest struct {
+	Title   string   `json:"title"`
+	Message string   `json:"message"`
+	Level   string   `json:"level"`
+	UserIds []string `json:"userIds"`
+}
+
+type SystemAnnouncement struct {
+	Id      string `json:"id"`
+	Title   string `json:"title,omitempty"`
+	Message string `json:"message"`
+	Level   string `json:"level"`
+	SentAt  int64  `json:"sentAt"`
+}
+
+type adminAction struct {
+	UserId     string                 `json:"userId,omitempty"`
+	Disconnect AdminDisconnectRequest `json:"disconnect"`
+}
+
+func registerAdminRoutes(r *gin.Engine, adminPassword string) {
+	admin := r.Group("/admin", AdminAuthMiddleware(adminPassword))
+	admin.GET("/users", handleAdminListUsers)
+	admin.GET("/users/:userId", handleAdminGetUser)
+	admin.POST("/users/:userId/disconnect", handleAdminDisconnect)
+	admin.DELETE("/users/:userId/presence", handleAdminClearPresence)
+	admin.GET("/voice-rooms", handleAdminListVoiceRooms)
+	admin.POST("/announcements", handleAdminAnnounce)
+	admin.GET("/inspect", handleAdminInspect)
+	admin.GET("/auth", handleAdminAuthStats)
+}
+
+func handleAdminListUsers(c *gin.Context) {
+	hub.lock.RLock()
+	userIds := make([]string, 0, len(hub.clients))
+	for userId := range hub.clients {
+		userIds = append(userIds, userId)
+	}
+	hub.lock.RUnlock()
+	sort.Strings(userIds)
+
+	response := AdminUsersResponse{
+		NodeId: cfg.NodeID,
+		Users:  make([]AdminUser, 0, len(userIds)),
+	}
+	for _, userId := range userIds {
+		response.Users = append(response.Users, describeLocalUser(userId))
+	}
+	response.OtherNodes = otherNodeUsers()
+	c.JSON(http.StatusOK, response)
+}
+
+func handleAdminGetUser(c *gin.Context) {
+	userId := c.Param("userId")
+	user := describeLocalUser(userId)
+
+	nodes, _ := redisClient.SMembers(ctx, clusterUserNodesPrefix+userId).Result()
+	c.JSON(http.StatusOK, gin.H{
+		"nodeId":   cfg.NodeID,
+		"user":     user,
+		"nodes":    nodes,
+		"presence": presence.effectiveStatuses([]string{userId})[userId],
+	})
+}
+
+// describeLocalUser reports the user's connections and detached sessions on
+// this node.
+func describeLocalUser(userId string) AdminUser {
+	hub.lock.RLock()
+	conns := append([]*WSConnection(nil), hub.clients[userId]...)
+	hub.lock.RUnlock()
+
+	user := AdminUser{
+		UserId:           userId,
+		Connections:      make([]AdminConnection, 0, len(conns)),
+		DetachedSessions: []string{},
+	}
+	for _, ws := range conns {
+		props := ws.clientProperties()
+		connection := AdminConnection{
+			Platform:     devicePlatform(props.Platform),
+			Version:      props.ClientVersion,
+			Codec:        ws.codec.name,
+			PingRttMs:    ws.pingRttMs(),
+			LastActivity: ws.lastActivity.Load(),
+			Queue:        ws.queueStats(),
+			Compression:  ws.compressor.stats(),
+		}
+		if session := ws.session(); session != nil {
+			connection.SessionId = session.ID
+			if subscribed, active := session.subscriptions.snapshot(); active {
+				connection.Subscribed = &subscribed
+			}
+		}
+		user.Connections = append(user.Connections, connection)
+	}
+	for _, session := range sessions.detachedForUser(userId) {
+		user.DetachedSessions = append(user.DetachedSessions, session.ID)
+	}
+
+	vcHub.mu.RLock()
+	_, user.InVoice = vcHub.clients[userId]
+	vcHub.mu.RUnlock()
+	return user
+}
+
+// otherNodeUsers lists the users registered by every other cluster node.
+func otherNodeUsers() map[string][]string {
+	if !cluster.enabled {
+		return nil
+	}
+	nodes, err := redisClient.SMembers(ctx, clusterNodesKey).Result()
+	if err != nil {
+		logErr("Error listing cluster nodes", err)
+		return nil
+	}
+	result := make(map[string][]string)
+	for _, nodeID := range nodes {
+		if nodeID == cluster.nodeID {
+			continue
+		}
+		users, err := redisClient.SMembers(ctx, clusterNodeUsersPrefix+nodeID).Result()
+		if err != nil {
+			continue
+		}
+		sort.Strings(users)
+		result[nodeID] = users
+	}
+	return result
+}
+
+func handleAdminListVoiceRooms(c *gin.Context) {
+	vcHub.mu.RLock()
+	rooms := make([]AdminVoiceRoom, 0, len(vcHub.rooms))
+	for roomId, clients := range vcHub.rooms {
+		room := AdminVoiceRoom{RoomId: roomId, Participants: make([]AdminVoiceParticipant, 0, len(clients))}
+		for _, client := range clients {
+			room.Participants = append(room.Participants, AdminVoiceParticipant{
+				UserId:       client.ID,
+				IsNoisy:      client.IsNoisy,
+				IsMuted:      client.IsMuted,
+				IsDeafened:   client.IsDeafened,
+				LastActivity: client.lastActivity.Load(),
+			})
+		}
+		rooms = append(rooms, room)
+	}
+	vcHub.mu.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].RoomId < rooms[j].RoomId })
+	c.JSON(http.StatusOK, gin.H{"nodeId": cfg.NodeID, "rooms": rooms})
+}
+
+// handleAdminDisconnect closes the user's sockets, or only the one bound to
+// sessionId, on every node. Their sessions are dropped so they cannot be
+// resumed.
+func handleAdminDisconnect(c *gin.Context) {
+	userId := c.Param("userId")
+	var request AdminDisconnectRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+	if request.Reason == "" {
+		request.Reason = "disconnected by an administrator"
+	}
+
+	closed := disconnectLocal(userId, request)
+	cluster.relayAdminAction(userId, adminActionDisconnect, adminAction{UserId: userId, Disconnect: request})
+	c.JSON(http.StatusOK, gin.H{"nodeId": cfg.NodeID, "closedLocally": closed})
+}
+
+// disconnectLocal closes the matching connections on this node and returns
+// how many were closed.
+func disconnectLocal(userId string, request AdminDisconnectRequest) int {
+	hub.lock.RLock()
+	conns := append([]*WSConnection(nil), hub.clients[userId]...)
+	hub.lock.RUnlock()
+
+	closed := 0
+	for _, ws := range conns {
+		session := ws.session()
+		if request.SessionId != "" && (session == nil || session.ID != request.SessionId) {
+			continue
+		}
+		ws.closeWithCode(closeAdminDisconnect, request.Reason)
+		if session != nil {
+			sessions.remove(session)
+		}
+		closed++
+	}
+	for _, session := range sessions.detachedForUser(userId) {
+		if request.SessionId == "" || session.ID == request.SessionId {
+			sessions.remove(session)
+		}
+	}
+
+	if request.IncludeVoice && request.SessionId == "" {
+		vcHub.mu.RLock()
+		client, ok := vcHub.clients[userId]
+		vcHub.mu.RUnlock()
+		if ok {
+			client.Conn.Close()
+			closed++
+		}
+	}
+	return closed
+}
+
+// handleAdminClearPresence resets the user's stored presence: chosen status,
+// idle flag, custom status and activities. Liveness left behind by nodes that
+// no longer hold the user is dropped as well, so a stuck "online" ghost goes
+// offline.
+func handleAdminClearPresence(c *gin.Context) {
+	userId := c.Param("userId")
+
+	live, err := redisClient.HGetAll(ctx, presenceLivePrefix+userId).Result()
+	if err != nil {
+		logErr("Error reading presence", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read presence"})
+		return
+	}
+
+	hub.lock.RLock()
+	_, connectedHere := hub.clients[userId]
+	hub.lock.RUnlock()
+
+	fresh, stale := splitLiveNodes(live, time.Now())
+	for _, nodeID := range fresh {
+		switch {
+		case nodeID == cfg.NodeID:
+			if !connectedHere {
+				stale = append(stale, nodeID)
+			}
+		case !cluster.enabled:
+			stale = append(stale, nodeID)
+		default:
+			if alive, err := redisClient.Exists(ctx, clusterNodeAlivePrefix+nodeID).Result(); err == nil && alive == 0 {
+				stale = append(stale, nodeID)
+			}
+		}
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.Del(ctx, presencePrefix+userId)
+	pipe.ZRem(ctx, presenceExpiryKey, "status:"+userId, "custom:"+userId, "activities:"+userId)
+	if len(stale) > 0 {
+		pipe.HDel(ctx, presenceLivePrefix+userId, stale...)
+		pipe.HDel(ctx, presenceActivePrefix+userId, stale...)
+		pipe.HDel(ctx, presenceDevicesPrefix+userId, stale...)
+	}
+	remaining := pipe.HLen(ctx, presenceLivePrefix+userId)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error clearing presence", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear presence"})
+		return
+	}
+	activity.forget(userId)
+
+	if remaining.Val() == 0 {
+		go broadcastStatusUpdate(userId, StatusOffline)
+	} else {
+		go broadcastPresenceChange(userId)
+	}
+	c.JSON(http.StatusOK, gin.H{"userId": userId, "removedNodes": stale, "live": remaining.Val() > 0})
+}
+
+// handleAdminAnnounce sends SYSTEM_ANNOUNCEMENT to the listed users, or to
+// everyone connected to the cluster when no users are given.
+func handleAdminAnnounce(c *gin.Context) {
+	var request AnnouncementRequest
+	if err := c.ShouldBindJSON(&request); err != nil || strings.TrimSpace(request.Message) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message is required"})
+		return
+	}
+	switch request.Level {
+	case "":
+		request.Level = "info"
+	case "info", "warning", "critical":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "level must be info, warning or critical"})
+		return
+	}
+
+	announcement := SystemAnnouncement{
+		Id:      newSessionID(),
+		Title:   request.Title,
+		Message: request.Message,
+		Level:   request.Level,
+		SentAt:  time.Now().UnixMilli(),
+	}
+
+	if len(request.UserIds) > 0 {
+		deliverToUsers(systemAnnouncementEvent, announcement, request.UserIds)
+	} else {
+		announceLocal(announcement)
+		cluster.relayAdminAction("", adminActionAnnounce, announcement)
+	}
+	c.JSON(http.StatusOK, announcement)
+}
+
+func announceLocal(announcement SystemAnnouncement) {
+	hub.lock.RLock()
+	userIds := make([]string, 0, len(hub.clients))
+	for userId := range hub.clients {
+		userIds = append(userIds, userId)
+	}
+	hub.lock.RUnlock()
+	deliverLocal(systemAnnouncementEvent, announcement, userIds)
+}
+
+// relayAdminAction hands an admin action to the nodes holding userId, or to
+// every other node when userId is empty.
+func (c *clusterNode) relayAdminAction(userId, action string, data interface{}) {
+	if !c.enabled {
+		return
+	}
+	var (
+		nodes []string
+		err   error
+	)
+	if userId == "" {
+		nodes, err = redisClient.SMembers(ctx, clusterNodesKey).Result()
+	} else {
+		nodes, err = redisClient.SMembers(ctx, clusterUserNodesPrefix+userId).Result()
+	}
+	if err != nil {
+		logErr("Error looking up nodes for admin action", err)
+		return
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		logErr("Error marshalling admin action", err)
+		return
+	}
+	for _, nodeID := range nodes {
+		if nodeID != c.nodeID {
+			c.publish(nodeID, clusterMessage{Kind: clusterKindAdmin, EventType: action, Data: raw})
+		}
+	}
+}
+
+// applyAdminAction runs an admin action relayed by another node.
+func applyAdminAction(action string, data json.RawMessage) {
+	switch action {
+	case adminActionDisconnect:
+		var request adminAction
+		if err := json.Unmarshal(data, &request); err == nil && request.UserId != "" {
+			disconnectLocal(request.UserId, request.Disconnect)
+		}
+	case adminActionAnnounce:
+		var announcement SystemAnnouncement
+		if err := json.Unmarshal(data, &announcement); err == nil {
+			announceLocal(announcement)
+		}
+	case adminActionRevoke:
+		var revocation RevocationPayload
+		if err := json.Unmarshal(data, &revocation); err == nil && revocation.UserId != "" {
+			revokeLocal(revocation)
+		}
+	}
+}
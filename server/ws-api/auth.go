@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every session token the gateway sees, whether it comes with a ticket
+// request, a legacy /ws or /video-ws upgrade or the periodic re-validation,
+// is checked by one authenticator against the .NET API's
+// /auth/validate-token. It keeps
+//
+//	accepted tokens  token      -> userId for AuthCacheTTL
+//	rejected tokens  token hash -> expiry for AuthNegativeCacheTTL
+//
+// and lets only one request per token reach the API at a time. Requests time
+// out after AuthTimeout. After AuthBreakerThreshold failures in a row the
+// circuit opens: for AuthBreakerCooldown tokens that are not cached are
+// refused with 503 right away, then a single request probes whether the API
+// is back. Counters and a latency histogram are served at /admin/auth.
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+
+	authNegativeCacheMax = 10000
+	authSweepInterval    = time.Minute
+)
+
+var errAuthUnavailable = errors.New("authentication service unavailable")
+
+var authLatencyBuckets = [...]time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+type authCacheEntry struct {
+	userId    string
+	expiresAt time.Time
+}
+
+// authCall is a validation in flight; callers asking about the same token
+// wait for it instead of sending their own request.
+type authCall struct {
+	done   chan struct{}
+	userId string
+	err    error
+}
+
+type authBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+	opens     uint64
+}
+
+type authMetrics struct {
+	requests          atomic.Uint64
+	cacheHits         atomic.Uint64
+	negativeCacheHits atomic.Uint64
+	accepted          atomic.Uint64
+	rejected          atomic.Uint64
+	failures          atomic.Uint64
+	shortCircuited    atomic.Uint64
+
+	latencyCount   atomic.Uint64
+	latencyTotalUs atomic.Int64
+	latencyMaxUs   atomic.Int64
+	latencyBuckets [len(authLatencyBuckets) + 1]atomic.Uint64
+}
+
+type sessionAuthenticator struct {
+	apiURL string
+	client *http.Client
+
+	mu       sync.Mutex
+	accepted map[string]authCacheEntry
+	rejected map[string]time.Time
+	inflight map[string]*authCall
+
+	breaker authBreaker
+	metrics authMetrics
+}
+
+type AuthLatencyStats struct {
+	Count   uint64            `json:"count"`
+	AvgMs   float64           `json:"avgMs"`
+	MaxMs   float64           `json:"maxMs"`
+	Buckets map[string]uint64 `json:"buckets"`
+}
+
+type AuthStats struct {
+	Requests          uint64           `json:"requests"`
+	CacheHits         uint64           `json:"cacheHits"`
+	NegativeCacheHits uint64           `json:"negativeCacheHits"`
+	Accepted          uint64           `json:"accepted"`
+	Rejected          uint64           `json:"rejected"`
+	Failures          uint64           `json:"failures"`
+	ShortCircuited    uint64           `json:"shortCircuited"`
+	Breaker           string           `json:"breaker"`
+	BreakerOpens      uint64           `json:"breakerOpens"`
+	CachedSessions    int              `json:"cachedSessions"`
+	CachedRejections  int              `json:"cachedRejections"`
+	Latency           AuthLatencyStats `json:"latency"`
+}
+
+var authenticator *sessionAuthenticator
+
+func newSessionAuthenticator(apiURL string) *sessionAuthenticator {
+	return &sessionAuthenticator{
+		apiURL:   strings.TrimRight(apiURL, "/"),
+		client:   &http.Client{Timeout: cfg.AuthTimeout},
+		accepted: make(map[string]authCacheEntry),
+		rejected: make(map[string]time.Time),
+		inflight: make(map[string]*authCall),
+	}
+}
+
+func startAuthenticator() {
+	authenticator = newSessionAuthenticator(getEnv("DotnetApiUrl", "http://localhost:5005"))
+	go func() {
+		ticker := time.NewTicker(authSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			authenticator.sweep()
+		}
+	}()
+}
+
+// authStatus is the HTTP status for a failed authentication: 503 while the API
+// cannot answer, so clients retry instead of logging out, and 401 otherwise.
+func authStatus(err error) int {
+	if errors.Is(err, errAuthUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusUnauthorized
+}
+
+// authenticate resolves a token to its user, from the cache when possible.
+func (a *sessionAuthenticator) authenticate(token string) (string, error) {
+	a.metrics.requests.Add(1)
+	now := time.Now()
+
+	a.mu.Lock()
+	if entry, ok := a.accepted[token]; ok && now.Before(entry.expiresAt) {
+		a.mu.Unlock()
+		a.metrics.cacheHits.Add(1)
+		return entry.userId, nil
+	}
+	a.mu.Unlock()
+
+	return a.check(token)
+}
+
+// validate asks the API about a token even if it is cached, for sockets that
+// authenticated a while ago.
+func (a *sessionAuthenticator) validate(token string) (string, error) {
+	a.metrics.requests.Add(1)
+	return a.check(token)
+}
+
+func (a *sessionAuthenticator) check(token string) (string, error) {
+	tokenHash := hashToken(token)
+
+	a.mu.Lock()
+	if expiresAt, ok := a.rejected[tokenHash]; ok {
+		if time.Now().Before(expiresAt) {
+			a.mu.Unlock()
+			a.metrics.negativeCacheHits.Add(1)
+			return "", errInvalidSession
+		}
+		delete(a.rejected, tokenHash)
+	}
+	if call, ok := a.inflight[token]; ok {
+		a.mu.Unlock()
+		<-call.done
+		return call.userId, call.err
+	}
+	call := &authCall{done: make(chan struct{})}
+	a.inflight[token] = call
+	a.mu.Unlock()
+
+	if a.breaker.allow() {
+		call.userId, call.err = a.fetch(token)
+		a.breaker.record(call.err == nil || errors.Is(call.err, errInvalidSession))
+	} else {
+		a.metrics.shortCircuited.Add(1)
+		call.err = errAuthUnavailable
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	delete(a.inflight, token)
+	switch {
+	case call.err == nil:
+		a.metrics.accepted.Add(1)
+		a.accepted[token] = authCacheEntry{userId: call.userId, expiresAt: now.Add(cfg.AuthCacheTTL)}
+	case errors.Is(call.err, errInvalidSession):
+		a.metrics.rejected.Add(1)
+		delete(a.accepted, token)
+		if cfg.AuthNegativeCacheTTL > 0 && len(a.rejected) < authNegativeCacheMax {
+			a.rejected[tokenHash] = now.Add(cfg.AuthNegativeCacheTTL)
+		}
+	}
+	a.mu.Unlock()
+	close(call.done)
+
+	return call.userId, call.err
+}
+
+// fetch sends one request to /auth/validate-token. Anything but an answer
+// about the token itself is reported as errAuthUnavailable.
+func (a *sessionAuthenticator) fetch(token string) (string, error) {
+	start := time.Now()
+	defer func() { a.metrics.observeLatency(time.Since(start)) }()
+
+	req, err := http.NewRequest("POST", a.apiURL+"/auth/validate-token", nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		a.metrics.failures.Add(1)
+		return "", fmt.Errorf("%w: %v", errAuthUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("%w. Status code: %d", errInvalidSession, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		a.metrics.failures.Add(1)
+		return "", fmt.Errorf("%w. Status code: %d", errAuthUnavailable, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		a.metrics.failures.Add(1)
+		return "", fmt.Errorf("%w: error reading response body: %v", errAuthUnavailable, err)
+	}
+
+	var parsed struct {
+		UserID string `json:"userId"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		a.metrics.failures.Add(1)
+		return "", fmt.Errorf("%w: error parsing response JSON: %v", errAuthUnavailable, err)
+	}
+
+	userId := strings.TrimSpace(parsed.UserID)
+	if userId == "" {
+		a.metrics.failures.Add(1)
+		return "", fmt.Errorf("%w: empty user ID returned from API", errAuthUnavailable)
+	}
+	return userId, nil
+}
+
+// evict drops the cached sessions that match, so the next connect with those
+// tokens goes to the API again.
+func (a *sessionAuthenticator) evict(matches func(userId, token string) bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for token, entry := range a.accepted {
+		if matches(entry.userId, token) {
+			delete(a.accepted, token)
+		}
+	}
+}
+
+func (a *sessionAuthenticator) sweep() {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for token, entry := range a.accepted {
+		if now.After(entry.expiresAt) {
+			delete(a.accepted, token)
+		}
+	}
+	for tokenHash, expiresAt := range a.rejected {
+		if now.After(expiresAt) {
+			delete(a.rejected, tokenHash)
+		}
+	}
+}
+
+func (a *sessionAuthenticator) stats() AuthStats {
+	a.mu.Lock()
+	cachedSessions, cachedRejections := len(a.accepted), len(a.rejected)
+	a.mu.Unlock()
+	state, opens := a.breaker.state()
+
+	return AuthStats{
+		Requests:          a.metrics.requests.Load(),
+		CacheHits:         a.metrics.cacheHits.Load(),
+		NegativeCacheHits: a.metrics.negativeCacheHits.Load(),
+		Accepted:          a.metrics.accepted.Load(),
+		Rejected:          a.metrics.rejected.Load(),
+		Failures:          a.metrics.failures.Load(),
+		ShortCircuited:    a.metrics.shortCircuited.Load(),
+		Breaker:           state,
+		BreakerOpens:      opens,
+		CachedSessions:    cachedSessions,
+		CachedRejections:  cachedRejections,
+		Latency:           a.metrics.latency(),
+	}
+}
+
+func (m *authMetrics) observeLatency(d time.Duration) {
+	us := d.Microseconds()
+	m.latencyCount.Add(1)
+	m.latencyTotalUs.Add(us)
+	for {
+		max := m.latencyMaxUs.Load()
+		if us <= max || m.latencyMaxUs.CompareAndSwap(max, us) {
+			break
+		}
+	}
+	bucket := len(authLatencyBuckets)
+	for i, limit := range authLatencyBuckets {
+		if d <= limit {
+			bucket = i
+			break
+		}
+	}
+	m.latencyBuckets[bucket].Add(1)
+}
+
+func (m *authMetrics) latency() AuthLatencyStats {
+	stats := AuthLatencyStats{
+		Count:   m.latencyCount.Load(),
+		MaxMs:   float64(m.latencyMaxUs.Load()) / 1000,
+		Buckets: make(map[string]uint64, len(authLatencyBuckets)+1),
+	}
+	if stats.Count > 0 {
+		stats.AvgMs = float64(m.latencyTotalUs.Load()) / float64(stats.Count) / 1000
+	}
+	for i, limit := range authLatencyBuckets {
+		stats.Buckets["le_"+limit.String()] = m.latencyBuckets[i].Load()
+	}
+	stats.Buckets["le_inf"] = m.latencyBuckets[len(authLatencyBuckets)].Load()
+	return stats
+}
+
+// allow reports whether a request may go to the API. While the circuit is
+// open nothing does; once the cooldown is over a single probe is let through.
+// A threshold of 0 disables the breaker.
+func (b *authBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cfg.AuthBreakerThreshold <= 0 || b.failures < cfg.AuthBreakerThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *authBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		if cfg.AuthBreakerThreshold > 0 && b.failures >= cfg.AuthBreakerThreshold {
+			fmt.Println("Authentication API is reachable again, closing circuit")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if cfg.AuthBreakerThreshold > 0 && b.failures >= cfg.AuthBreakerThreshold {
+		if b.failures == cfg.AuthBreakerThreshold {
+			b.opens++
+			fmt.Printf("Authentication API failed %d times in a row, opening circuit for %s\n", b.failures, cfg.AuthBreakerCooldown)
+		}
+		b.openUntil = time.Now().Add(cfg.AuthBreakerCooldown)
+	}
+}
+
+func (b *authBreaker) state() (string, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case cfg.AuthBreakerThreshold <= 0 || b.failures < cfg.AuthBreakerThreshold:
+		return breakerClosed, b.opens
+	case time.Now().Before(b.openUntil):
+		return breakerOpen, b.opens
+	default:
+		return breakerHalfOpen, b.opens
+	}
+}
+
+func handleAdminAuthStats(c *gin.Context) {
+	c.JSON(http.StatusOK, authenticator.stats())
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthBreakerTransitions(t *testing.T) {
+	previous := cfg
+	t.Cleanup(func() { cfg = previous })
+	cfg.AuthBreakerCooldown = time.Hour
+
+	// Steps: "fail" and "ok" record a result, "cool" ends the cooldown,
+	// "allow" and "deny" check allow, anything else is the expected state.
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []string
+		wantOpens uint64
+	}{
+		{"stays closed below the threshold", 3, []string{
+			"fail", "fail", breakerClosed, "allow", "ok", "fail", "fail", breakerClosed,
+		}, 0},
+		{"opens at the threshold", 3, []string{
+			"fail", "fail", "fail", breakerOpen, "deny", "deny",
+		}, 1},
+		{"half-open lets one probe through", 2, []string{
+			"fail", "fail", "cool", breakerHalfOpen, "allow", "deny", "deny",
+		}, 1},
+		{"successful probe closes", 2, []string{
+			"fail", "fail", "cool", "allow", "ok", breakerClosed, "allow", "allow",
+		}, 1},
+		{"failed probe reopens without counting a new open", 2, []string{
+			"fail", "fail", "cool", "allow", "fail", breakerOpen, "deny",
+			"cool", "allow", "ok", breakerClosed,
+		}, 1},
+		{"opens again after closing", 2, []string{
+			"fail", "fail", "cool", "allow", "ok", "fail", "fail", breakerOpen,
+		}, 2},
+		{"zero threshold disables it", 0, []string{
+			"fail", "fail", "fail", "fail", breakerClosed, "allow", "allow",
+		}, 0},
+	}
+
+	for _, tt := range tests {
+		cfg.AuthBreakerThreshold = tt.threshold
+		var b authBreaker
+		for i, step := range tt.steps {
+			switch step {
+			case "fail", "ok":
+				b.record(step == "ok")
+			case "cool":
+				b.mu.Lock()
+				b.openUntil = time.Now().Add(-time.Second)
+				b.mu.Unlock()
+			case "allow", "deny":
+				if got := b.allow(); got != (step == "allow") {
+					t.Errorf("%s: step %d: allow = %v, want %v", tt.name, i, got, step == "allow")
+				}
+			default:
+				if state, _ := b.state(); state != step {
+					t.Errorf("%s: step %d: state = %s, want %s", tt.name, i, state, step)
+				}
+			}
+		}
+		if _, opens := b.state(); opens != tt.wantOpens {
+			t.Errorf("%s: opened %d times, want %d", tt.name, opens, tt.wantOpens)
+		}
+	}
+}
+
+func TestAuthenticatorShortCircuitsWhileAPIIsDown(t *testing.T) {
+	previous := cfg
+	t.Cleanup(func() { cfg = previous })
+	cfg.AuthBreakerThreshold = 2
+	cfg.AuthBreakerCooldown = time.Hour
+	cfg.AuthCacheTTL = time.Minute
+	cfg.AuthNegativeCacheTTL = time.Minute
+
+	var healthy atomic.Bool
+	var calls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch {
+		case !healthy.Load():
+			w.WriteHeader(http.StatusBadGateway)
+		case r.Header.Get("Authorization") == "Bearer good":
+			w.Write([]byte(`{"userId":"user"}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer api.Close()
+	a := newSessionAuthenticator(api.URL)
+
+	for i := 0; i < 2; i++ {
+		if _, err := a.validate("good"); !errors.Is(err, errAuthUnavailable) {
+			t.Fatalf("failure %d: err = %v", i+1, err)
+		}
+	}
+	if _, err := a.validate("good"); !errors.Is(err, errAuthUnavailable) || calls.Load() != 2 {
+		t.Fatalf("open circuit: err = %v after %d calls, want a short circuit", err, calls.Load())
+	}
+
+	healthy.Store(true)
+	a.breaker.mu.Lock()
+	a.breaker.openUntil = time.Now().Add(-time.Second)
+	a.breaker.mu.Unlock()
+	if userId, err := a.validate("good"); err != nil || userId != "user" {
+		t.Fatalf("probe: %q, %v", userId, err)
+	}
+	if state, _ := a.breaker.state(); state != breakerClosed {
+		t.Fatalf("state after a good probe = %s", state)
+	}
+
+	// Rejected tokens are answers, not failures.
+	for i := 0; i < 3; i++ {
+		if _, err := a.validate("bad-" + string(rune('a'+i))); !errors.Is(err, errInvalidSession) {
+			t.Fatalf("bad token: err = %v", err)
+		}
+	}
+	if state, _ := a.breaker.state(); state != breakerClosed {
+		t.Fatalf("rejections opened the circuit: %s", state)
+	}
+}
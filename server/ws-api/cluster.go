@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Cluster mode lets several ws-api replicas run behind one load balancer.
+// Every node registers the users, sessions and voice clients it holds in
+// Redis and listens on its own pub/sub channel. Deliveries for users held by
+// another node are published to that node's channel instead of being dropped.
+// Nodes refresh a liveness key on a heartbeat; when a node's key expires the
+// surviving nodes remove its users from the registry and announce them
+// offline. A node that shuts down cleanly does this for itself, and a node
+// that was reaped while it was merely stalled registers its users again and
+// announces them online once its heartbeat gets through.
+//
+// Gateway sessions are not shared between nodes, so RESUME needs the load
+// balancer to route reconnects to the node that holds the session.
+
+const (
+	clusterNodesKey          = "ws_nodes"
+	clusterNodeAlivePrefix   = "ws_node_alive:"
+	clusterNodeUsersPrefix   = "ws_node_users:"
+	clusterNodeSessionPrefix = "ws_node_sessions:"
+	clusterNodeVoicePrefix   = "ws_node_vc_users:"
+	clusterNodeReapPrefix    = "ws_node_reap:"
+	clusterUserNodesPrefix   = "ws_user_nodes:"
+	clusterVoiceNodesKey     = "ws_vc_user_nodes"
+	clusterChannelPrefix     = "ws_node_events:"
+)
+
+const (
+	clusterKindUsers      = "users"
+	clusterKindVoice      = "voice"
+	clusterKindAdmin      = "admin"
+	clusterKindMembership = "membership"
+)
+
+type clusterMessage struct {
+	Kind      string          `json:"kind"`
+	From      string          `json:"from"`
+	UserIDs   []string        `json:"userIds,omitempty"`
+	EventType string          `json:"eventType,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	TargetID  string          `json:"targetId,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+type clusterNode struct {
+	enabled bool
+	nodeID  string
+}
+
+var cluster = &clusterNode{}
+
+func startCluster() error {
+	if !cfg.ClusterMode {
+		return nil
+	}
+
+	cluster.nodeID = cfg.NodeID
+	cluster.enabled = true
+
+	// A node restarting under the same ID must not inherit the registrations
+	// of its previous run.
+	cluster.reapNode(cluster.nodeID)
+	if _, err := cluster.heartbeat(); err != nil {
+		return err
+	}
+
+	pubsub := redisClient.Subscribe(ctx, clusterChannelPrefix+cluster.nodeID)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	go cluster.listen(pubsub)
+	go cluster.heartbeatLoop()
+
+	fmt.Printf("Cluster mode enabled, node ID %s\n", cluster.nodeID)
+	return nil
+}
+
+// heartbeat refreshes the node's liveness key. It reports whether the node
+// had to be added back to the node list, which means another node reaped it.
+func (c *clusterNode) heartbeat() (bool, error) {
+	pipe := redisClient.Pipeline()
+	pipe.Set(ctx, clusterNodeAlivePrefix+c.nodeID, time.Now().Unix(), cfg.NodeTimeout)
+	added := pipe.SAdd(ctx, clusterNodesKey, c.nodeID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return added.Val() > 0, nil
+}
+
+func (c *clusterNode) heartbeatLoop() {
+	ticker := time.NewTicker(cfg.NodeHeartbeat)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// A draining node lets its heartbeat lapse so the others take over.
+		if draining.Load() {
+			return
+		}
+		reaped, err := c.heartbeat()
+		if err != nil {
+			logErr("Error refreshing node heartbeat", err)
+			continue
+		}
+		if reaped {
+			fmt.Printf("Cluster node %s was reaped while running, registering its users again\n", c.nodeID)
+			c.rejoin()
+		}
+		c.reapDeadNodes()
+	}
+}
+
+func (c *clusterNode) reapDeadNodes() {
+	nodes, err := redisClient.SMembers(ctx, clusterNodesKey).Result()
+	if err != nil {
+		logErr("Error listing cluster nodes", err)
+		return
+	}
+
+	for _, nodeID := range nodes {
+		if nodeID == c.nodeID {
+			continue
+		}
+		alive, err := redisClient.Exists(ctx, clusterNodeAlivePrefix+nodeID).Result()
+		if err != nil || alive > 0 {
+			continue
+		}
+
+		// Only one surviving node cleans up after a dead one.
+		acquired, err := redisClient.SetNX(ctx, clusterNodeReapPrefix+nodeID, c.nodeID, cfg.NodeTimeout).Result()
+		if err != nil || !acquired {
+			continue
+		}
+
+		fmt.Printf("Cluster node %s stopped heartbeating, cleaning up\n", nodeID)
+		for _, userId := range c.reapNode(nodeID) {
+			go announceOffline(userId)
+		}
+	}
+}
+
+// reapNode removes every registration owned by nodeID and returns the users
+// that are no longer connected to any node.
+func (c *clusterNode) reapNode(nodeID string) []string {
+	users, err := redisClient.SMembers(ctx, clusterNodeUsersPrefix+nodeID).Result()
+	if err != nil {
+		logErr("Error listing users of node "+nodeID, err)
+		return nil
+	}
+	voiceUsers, _ := redisClient.SMembers(ctx, clusterNodeVoicePrefix+nodeID).Result()
+
+	var offline []string
+	for _, userId := range users {
+		key := clusterUserNodesPrefix + userId
+		redisClient.SRem(ctx, key, nodeID)
+		redisClient.HDel(ctx, presenceLivePrefix+userId, nodeID)
+		redisClient.HDel(ctx, presenceActivePrefix+userId, nodeID)
+		redisClient.HDel(ctx, presenceDevicesPrefix+userId, nodeID)
+		if remaining, err := redisClient.SCard(ctx, key).Result(); err == nil && remaining == 0 {
+			offline = append(offline, userId)
+		}
+	}
+	for _, userId := range voiceUsers {
+		if owner, err := redisClient.HGet(ctx, clusterVoiceNodesKey, userId).Result(); err == nil && owner == nodeID {
+			redisClient.HDel(ctx, clusterVoiceNodesKey, userId)
+		}
+	}
+
+	redisClient.Del(ctx,
+		clusterNodeUsersPrefix+nodeID,
+		clusterNodeSessionPrefix+nodeID,
+		clusterNodeVoicePrefix+nodeID,
+		clusterNodeAlivePrefix+nodeID,
+	)
+	redisClient.SRem(ctx, clusterNodesKey, nodeID)
+	return offline
+}
+
+// rejoin restores what reapNode removed for the users, sessions and voice
+// clients still held here and announces the users online again, since the
+// node that reaped this one reported them offline.
+func (c *clusterNode) rejoin() {
+	hub.lock.RLock()
+	userIds := make([]string, 0, len(hub.clients))
+	for userId := range hub.clients {
+		userIds = append(userIds, userId)
+	}
+	hub.lock.RUnlock()
+
+	sessions.mu.RLock()
+	sessionUsers := make(map[string]string, len(sessions.sessions))
+	for sessionId, s := range sessions.sessions {
+		sessionUsers[sessionId] = s.UserID
+	}
+	sessions.mu.RUnlock()
+
+	vcHub.mu.RLock()
+	voiceUsers := make([]string, 0, len(vcHub.clients))
+	for userId := range vcHub.clients {
+		voiceUsers = append(voiceUsers, userId)
+	}
+	vcHub.mu.RUnlock()
+
+	pipe := redisClient.Pipeline()
+	for _, userId := range userIds {
+		pipe.SAdd(ctx, clusterUserNodesPrefix+userId, c.nodeID)
+		pipe.SAdd(ctx, clusterNodeUsersPrefix+c.nodeID, userId)
+	}
+	for sessionId, userId := range sessionUsers {
+		pipe.SAdd(ctx, clusterUserNodesPrefix+userId, c.nodeID)
+		pipe.SAdd(ctx, clusterNodeUsersPrefix+c.nodeID, userId)
+		pipe.HSet(ctx, clusterNodeSessionPrefix+c.nodeID, sessionId, userId)
+	}
+	for _, userId := range voiceUsers {
+		pipe.HSet(ctx, clusterVoiceNodesKey, userId, c.nodeID)
+		pipe.SAdd(ctx, clusterNodeVoicePrefix+c.nodeID, userId)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error registering node again", err)
+	}
+
+	presence.markLive(userIds...)
+	for _, userId := range userIds {
+		devices.sync(userId)
+	}
+	for _, response := range presence.effectiveStatuses(userIds) {
+		if response.Status != StatusOffline {
+			broadcastStatusResponse(response)
+		}
+	}
+}
+
+func (c *clusterNode) registerSession(userId, sessionId string) {
+	if !c.enabled {
+		return
+	}
+	pipe := redisClient.Pipeline()
+	pipe.SAdd(ctx, clusterUserNodesPrefix+userId, c.nodeID)
+	pipe.SAdd(ctx, clusterNodeUsersPrefix+c.nodeID, userId)
+	pipe.HSet(ctx, clusterNodeSessionPrefix+c.nodeID, sessionId, userId)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error registering session in cluster", err)
+	}
+}
+
+// unregisterSession drops a session; lastSession is true when the user has no
+// other session left on this node.
+func (c *clusterNode) unregisterSession(userId, sessionId string, lastSession bool) {
+	if !c.enabled {
+		return
+	}
+	pipe := redisClient.Pipeline()
+	pipe.HDel(ctx, clusterNodeSessionPrefix+c.nodeID, sessionId)
+	if lastSession {
+		pipe.SRem(ctx, clusterUserNodesPrefix+userId, c.nodeID)
+		pipe.SRem(ctx, clusterNodeUsersPrefix+c.nodeID, userId)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error unregistering session in cluster", err)
+	}
+}
+
+func (c *clusterNode) registerVoiceClient(userId string) {
+	if !c.enabled {
+		return
+	}
+	pipe := redisClient.Pipeline()
+	pipe.HSet(ctx, clusterVoiceNodesKey, userId, c.nodeID)
+	pipe.SAdd(ctx, clusterNodeVoicePrefix+c.nodeID, userId)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error registering voice client in cluster", err)
+	}
+}
+
+func (c *clusterNode) unregisterVoiceClient(userId string) {
+	if !c.enabled {
+		return
+	}
+	if owner, err := redisClient.HGet(ctx, clusterVoiceNodesKey, userId).Result(); err == nil && owner == c.nodeID {
+		redisClient.HDel(ctx, clusterVoiceNodesKey, userId)
+	}
+	redisClient.SRem(ctx, clusterNodeVoicePrefix+c.nodeID, userId)
+}
+
+// routeToUsers publishes the event to every other node that holds one of the
+// target users, batching the users per node.
+func (c *clusterNode) routeToUsers(eventType string, payload interface{}, userIDs []string) {
+	if !c.enabled || len(userIDs) == 0 {
+		return
+	}
+
+	pipe := redisClient.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(userIDs))
+	for i, userId := range userIDs {
+		cmds[i] = pipe.SMembers(ctx, clusterUserNodesPrefix+userId)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		logErr("Error looking up user nodes", err)
+		return
+	}
+
+	byNode := make(map[string][]string)
+	for i, cmd := range cmds {
+		for _, nodeID := range cmd.Val() {
+			if nodeID != c.nodeID {
+				byNode[nodeID] = append(byNode[nodeID], userIDs[i])
+			}
+		}
+	}
+	if len(byNode) == 0 {
+		return
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		logErr("Error marshalling cluster payload", err)
+		return
+	}
+
+	for nodeID, users := range byNode {
+		c.publish(nodeID, clusterMessage{
+			Kind:      clusterKindUsers,
+			UserIDs:   users,
+			EventType: eventType,
+			Payload:   raw,
+		})
+	}
+}
+
+// forwardVoice hands a voice envelope to the node holding the target client.
+func (c *clusterNode) forwardVoice(targetID string, envelope []byte) bool {
+	if !c.enabled {
+		return false
+	}
+	nodeID, err := redisClient.HGet(ctx, clusterVoiceNodesKey, targetID).Result()
+	if err != nil || nodeID == c.nodeID {
+		return false
+	}
+	c.publish(nodeID, clusterMessage{
+		Kind:     clusterKindVoice,
+		TargetID: targetID,
+		Data:     envelope,
+	})
+	return true
+}
+
+func (c *clusterNode) publish(nodeID string, msg clusterMessage) {
+	msg.From = c.nodeID
+	b, err := json.Marshal(msg)
+	if err != nil {
+		logErr("Error marshalling cluster message", err)
+		return
+	}
+	if err := redisClient.Publish(ctx, clusterChannelPrefix+nodeID, b).Err(); err != nil {
+		logErr("Error publishing to node "+nodeID, err)
+	}
+}
+
+func (c *clusterNode) listen(pubsub *redis.PubSub) {
+	for msg := range pubsub.Channel() {
+		c.handle(msg.Payload)
+	}
+}
+
+func (c *clusterNode) handle(raw string) {
+	var m clusterMessage
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		logErr("Error decoding cluster message", err)
+		return
+	}
+
+	switch m.Kind {
+	case clusterKindUsers:
+		deliverLocal(m.EventType, m.Payload, m.UserIDs)
+	case clusterKindVoice:
+		deliverVoiceLocal(m.TargetID, m.Data)
+	case clusterKindAdmin:
+		applyAdminAction(m.EventType, m.Data)
+	case clusterKindMembership:
+		memberships.applyEvent(EventMessage{EventType: m.EventType, Payload: m.Payload}, m.UserIDs)
+	}
+}
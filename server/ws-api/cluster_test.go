@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReapedNodeRejoins(t *testing.T) {
+	f := startFakeRedis(t)
+	previous, previousCluster := cfg, *cluster
+	t.Cleanup(func() {
+		cfg = previous
+		*cluster = previousCluster
+	})
+	cfg.NodeID = "node-a"
+	cfg.NodeTimeout = 15 * time.Second
+	cfg.PresenceTTL = 90 * time.Second
+	cluster.enabled = true
+	cluster.nodeID = "node-a"
+
+	ws := &WSConnection{Send: make(chan []byte, 8), done: make(chan struct{})}
+	session := &GatewaySession{ID: "session-1", UserID: "user-1", conn: ws}
+	ws.setSession(session)
+	hub.lock.Lock()
+	hub.clients["user-1"] = []*WSConnection{ws}
+	hub.lock.Unlock()
+	sessions.mu.Lock()
+	sessions.sessions[session.ID] = session
+	sessions.mu.Unlock()
+	t.Cleanup(func() {
+		hub.lock.Lock()
+		delete(hub.clients, "user-1")
+		hub.lock.Unlock()
+		sessions.mu.Lock()
+		delete(sessions.sessions, session.ID)
+		sessions.mu.Unlock()
+	})
+
+	if reaped, err := cluster.heartbeat(); err != nil || !reaped {
+		t.Fatalf("first heartbeat after a reap: reaped = %v, err = %v", reaped, err)
+	}
+	cluster.rejoin()
+	if reaped, err := cluster.heartbeat(); err != nil || reaped {
+		t.Fatalf("second heartbeat: reaped = %v, err = %v", reaped, err)
+	}
+
+	if got := redisClient.SMembers(ctx, clusterUserNodesPrefix+"user-1").Val(); !reflect.DeepEqual(got, []string{"node-a"}) {
+		t.Errorf("user registered on %v, want [node-a]", got)
+	}
+	if got := redisClient.HGet(ctx, clusterNodeSessionPrefix+"node-a", "session-1").Val(); got != "user-1" {
+		t.Errorf("session registered for %q", got)
+	}
+	if !redisClient.HExists(ctx, presenceLivePrefix+"user-1", "node-a").Val() {
+		t.Error("user not marked live again")
+	}
+
+	var online []string
+	for _, raw := range f.messages(presenceUpdatesChannel) {
+		var response UserStatusResponse
+		if json.Unmarshal([]byte(raw), &response) == nil && response.Status == StatusOnline {
+			online = append(online, response.UserId)
+		}
+	}
+	if !reflect.DeepEqual(online, []string{"user-1"}) {
+		t.Fatalf("announced online %v, want [user-1]", online)
+	}
+}
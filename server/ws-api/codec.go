@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+// Clients pick the wire encoding with encoding=json|msgpack|cbor when they
+// connect to /ws or /video-ws. Everything inside the server (replay buffers,
+// cluster routing, the .NET payloads) stays JSON; frames are transcoded in the
+// connection's writer just before compression, and inbound frames are turned
+// back into JSON before they reach the event handlers.
+
+const (
+	encodingJSON    = "json"
+	encodingMsgpack = "msgpack"
+	encodingCBOR    = "cbor"
+)
+
+type wireCodec struct {
+	name   string
+	handle codec.Handle
+}
+
+var (
+	jsonCodec    = &wireCodec{name: encodingJSON}
+	msgpackCodec = &wireCodec{name: encodingMsgpack, handle: newMsgpackHandle()}
+	cborCodec    = &wireCodec{name: encodingCBOR, handle: newCborHandle()}
+)
+
+var genericMapType = reflect.TypeOf(map[string]interface{}(nil))
+
+func newMsgpackHandle() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.WriteExt = true
+	h.RawToString = true
+	h.MapType = genericMapType
+	return h
+}
+
+func newCborHandle() *codec.CborHandle {
+	h := &codec.CborHandle{}
+	h.MapType = genericMapType
+	return h
+}
+
+// codecForRequest returns the codec the client asked for, defaulting to JSON.
+func codecForRequest(r *http.Request) *wireCodec {
+	switch r.URL.Query().Get("encoding") {
+	case encodingMsgpack:
+		return msgpackCodec
+	case encodingCBOR:
+		return cborCodec
+	default:
+		return jsonCodec
+	}
+}
+
+func (c *wireCodec) messageType() int {
+	if c == nil || c.handle == nil {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+// fromJSON re-encodes a JSON frame in the connection's encoding. Integers
+// stay integers, so IDs and timestamps beyond 2^53 keep every digit.
+func (c *wireCodec) fromJSON(frame []byte) ([]byte, error) {
+	if c == nil || c.handle == nil {
+		return frame, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(frame))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	value = resolveNumbers(value)
+
+	var out []byte
+	if err := codec.NewEncoderBytes(&out, c.handle).Encode(value); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// resolveNumbers replaces the json.Numbers in a decoded value with int64,
+// uint64 or float64, whichever holds the number exactly.
+func resolveNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = resolveNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = resolveNumbers(item)
+		}
+	}
+	return value
+}
+
+// toJSON converts an inbound frame to JSON so it can be decoded into the
+// usual event structs.
+func (c *wireCodec) toJSON(frame []byte) ([]byte, error) {
+	if c == nil || c.handle == nil {
+		return frame, nil
+	}
+
+	var value interface{}
+	if err := codec.NewDecoderBytes(frame, c.handle).Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// decode unmarshals an inbound frame into v.
+func (c *wireCodec) decode(frame []byte, v interface{}) error {
+	data, err := c.toJSON(frame)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestWireCodecRoundTrip(t *testing.T) {
+	frames := []struct {
+		name string
+		json string
+	}{
+		{"event envelope", `{"eventType":"READY","payload":{"sessionId":"abc","userId":"123"}}`},
+		{"integer beyond 2^53", `{"id":9007199254740993}`},
+		{"int64 bounds", `{"max":9223372036854775807,"min":-9223372036854775808}`},
+		{"uint64 max", `{"n":18446744073709551615}`},
+		{"float", `{"ratio":1.5,"small":-0.25}`},
+		{"nested", `{"a":[1,"two",{"three":[true,false,null]}],"b":{}}`},
+		{"empty array", `{"list":[]}`},
+		{"unicode", `{"text":"héllo 👋"}`},
+	}
+
+	for _, wc := range []*wireCodec{msgpackCodec, cborCodec} {
+		for _, frame := range frames {
+			encoded, err := wc.fromJSON([]byte(frame.json))
+			if err != nil {
+				t.Errorf("%s/%s: fromJSON: %v", wc.name, frame.name, err)
+				continue
+			}
+			decoded, err := wc.toJSON(encoded)
+			if err != nil {
+				t.Errorf("%s/%s: toJSON: %v", wc.name, frame.name, err)
+				continue
+			}
+			if string(decoded) != frame.json {
+				t.Errorf("%s/%s: round trip = %s, want %s", wc.name, frame.name, decoded, frame.json)
+			}
+		}
+	}
+}
+
+func TestWireCodecKeepsIntegersIntegral(t *testing.T) {
+	for _, wc := range []*wireCodec{msgpackCodec, cborCodec} {
+		encoded, err := wc.fromJSON([]byte(`{"id":9007199254740993,"big":18446744073709551615,"f":2.5}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value map[string]interface{}
+		if err := codec.NewDecoderBytes(encoded, wc.handle).Decode(&value); err != nil {
+			t.Fatal(err)
+		}
+		switch id := value["id"].(type) {
+		case int64:
+			if id != 9007199254740993 {
+				t.Errorf("%s: id = %d, want 9007199254740993", wc.name, id)
+			}
+		case uint64:
+			if id != 9007199254740993 {
+				t.Errorf("%s: id = %d, want 9007199254740993", wc.name, id)
+			}
+		default:
+			t.Errorf("%s: id = %#v, want an integer", wc.name, value["id"])
+		}
+		if big, ok := value["big"].(uint64); !ok || big != 18446744073709551615 {
+			t.Errorf("%s: big = %#v, want uint64 max", wc.name, value["big"])
+		}
+		if f, ok := value["f"].(float64); !ok || f != 2.5 {
+			t.Errorf("%s: f = %#v, want float64 2.5", wc.name, value["f"])
+		}
+	}
+}
+
+func TestJSONCodecPassesFramesThrough(t *testing.T) {
+	frame := []byte(`{"id":9007199254740993}`)
+	for _, direction := range []func([]byte) ([]byte, error){jsonCodec.fromJSON, jsonCodec.toJSON} {
+		out, err := direction(frame)
+		if err != nil || string(out) != string(frame) {
+			t.Fatalf("json codec changed the frame: %s, %v", out, err)
+		}
+	}
+}
+
+func TestCodecForRequest(t *testing.T) {
+	tests := []struct {
+		query string
+		want  *wireCodec
+	}{
+		{"", jsonCodec},
+		{"?encoding=json", jsonCodec},
+		{"?encoding=msgpack", msgpackCodec},
+		{"?encoding=cbor", cborCodec},
+		{"?encoding=etf", jsonCodec},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws"+tt.query, nil)
+		if got := codecForRequest(r); got != tt.want {
+			t.Errorf("%q: codec = %s, want %s", tt.query, got.name, tt.want.name)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// GatewayConfig holds the tunables read from the environment. It is filled by
+// loadGatewayConfig once the .env file has been loaded.
+type GatewayConfig struct {
+	ReplayBufferSize    int
+	SessionResumeWindow time.Duration
+	SendQueueSize       int
+	HeartbeatInterval   time.Duration
+	MaxMissedHeartbeats int
+
+	StreamConsumerGroup string
+	StreamConsumerName  string
+	StreamClaimIdle     time.Duration
+	StreamMaxDeliveries int
+	MembershipReconcile time.Duration
+
+	ClusterMode   bool
+	NodeID        string
+	NodeHeartbeat time.Duration
+	NodeTimeout   time.Duration
+
+	PresenceRefresh time.Duration
+	PresenceTTL     time.Duration
+	IdleTimeout     time.Duration
+
+	HeartbeatRateLimit       rateLimitRule
+	TypingRateLimit          rateLimitRule
+	StatusUpdateRateLimit    rateLimitRule
+	StatusQueryRateLimit     rateLimitRule
+	DefaultRateLimit         rateLimitRule
+	RateLimitMaxViolations   int
+	RateLimitViolationWindow time.Duration
+
+	VapidPrivateKey            string
+	VapidSubject               string
+	PushTTL                    time.Duration
+	PushCollapseWindow         time.Duration
+	PushWorkers                int
+	PushAllowInsecureEndpoints bool
+	PushAllowedHosts           []string
+
+	DebugEventDump bool
+
+	ShutdownTimeout         time.Duration
+	ShutdownReconnectJitter time.Duration
+
+	TokenRevalidateInterval time.Duration
+
+	ConnectionTicketTTL  time.Duration
+	AllowLegacyTokenAuth bool
+
+	AuthTimeout          time.Duration
+	AuthCacheTTL         time.Duration
+	AuthNegativeCacheTTL time.Duration
+	AuthBreakerThreshold int
+	AuthBreakerCooldown  time.Duration
+}
+
+var cfg = GatewayConfig{
+	ReplayBufferSize:    256,
+	SessionResumeWindow: 60 * time.Second,
+	SendQueueSize:       512,
+	HeartbeatInterval:   30 * time.Second,
+	MaxMissedHeartbeats: 3,
+	StreamConsumerGroup: "ws-api",
+	StreamConsumerName:  "ws-api",
+	StreamClaimIdle:     60 * time.Second,
+	StreamMaxDeliveries: 5,
+	MembershipReconcile: 5 * time.Minute,
+	NodeHeartbeat:       5 * time.Second,
+	NodeTimeout:         15 * time.Second,
+	PresenceRefresh:     30 * time.Second,
+	PresenceTTL:         90 * time.Second,
+	IdleTimeout:         5 * time.Minute,
+
+	HeartbeatRateLimit:       rateLimitRule{Count: 30, Window: 60 * time.Second},
+	TypingRateLimit:          rateLimitRule{Count: 10, Window: 10 * time.Second},
+	StatusUpdateRateLimit:    rateLimitRule{Count: 5, Window: 60 * time.Second},
+	StatusQueryRateLimit:     rateLimitRule{Count: 10, Window: 10 * time.Second},
+	DefaultRateLimit:         rateLimitRule{Count: 60, Window: 10 * time.Second},
+	RateLimitMaxViolations:   20,
+	RateLimitViolationWindow: 60 * time.Second,
+
+	PushTTL:            24 * time.Hour,
+	PushCollapseWindow: 30 * time.Second,
+	PushWorkers:        4,
+
+	ShutdownTimeout:         15 * time.Second,
+	ShutdownReconnectJitter: 10 * time.Second,
+
+	TokenRevalidateInterval: 10 * time.Minute,
+
+	ConnectionTicketTTL: 30 * time.Second,
+
+	AuthTimeout:          5 * time.Second,
+	AuthCacheTTL:         5 * time.Minute,
+	AuthNegativeCacheTTL: 30 * time.Second,
+	AuthBreakerThreshold: 5,
+	AuthBreakerCooldown:  30 * time.Second,
+}
+
+func loadGatewayConfig() {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = cfg.StreamConsumerName
+	}
+
+	cfg = GatewayConfig{
+		ReplayBufferSize:    getEnvInt("ReplayBufferSize", cfg.ReplayBufferSize),
+		SessionResumeWindow: getEnvSeconds("SessionResumeWindowSeconds", cfg.SessionResumeWindow),
+		SendQueueSize:       getEnvInt("SendQueueSize", cfg.SendQueueSize),
+		HeartbeatInterval:   getEnvSeconds("HeartbeatIntervalSeconds", cfg.HeartbeatInterval),
+		MaxMissedHeartbeats: getEnvInt("MaxMissedHeartbeats", cfg.MaxMissedHeartbeats),
+		StreamConsumerGroup: getEnv("RedisConsumerGroup", cfg.StreamConsumerGroup),
+		StreamConsumerName:  getEnv("RedisConsumerName", hostname),
+		StreamClaimIdle:     getEnvSeconds("RedisClaimIdleSeconds", cfg.StreamClaimIdle),
+		StreamMaxDeliveries: getEnvInt("RedisMaxDeliveries", cfg.StreamMaxDeliveries),
+		MembershipReconcile: getEnvSeconds("MembershipReconcileSeconds", cfg.MembershipReconcile),
+
+		ClusterMode:   getEnvBool("ClusterMode", false),
+		NodeID:        getEnv("NodeID", hostname),
+		NodeHeartbeat: getEnvSeconds("NodeHeartbeatSeconds", cfg.NodeHeartbeat),
+		NodeTimeout:   getEnvSeconds("NodeTimeoutSeconds", cfg.NodeTimeout),
+
+		PresenceRefresh: getEnvSeconds("PresenceRefreshSeconds", cfg.PresenceRefresh),
+		PresenceTTL:     getEnvSeconds("PresenceTTLSeconds", cfg.PresenceTTL),
+		IdleTimeout:     getEnvSeconds("IdleTimeoutSeconds", cfg.IdleTimeout),
+
+		HeartbeatRateLimit:       getEnvRateLimit("HeartbeatRateLimit", cfg.HeartbeatRateLimit),
+		TypingRateLimit:          getEnvRateLimit("TypingRateLimit", cfg.TypingRateLimit),
+		StatusUpdateRateLimit:    getEnvRateLimit("StatusUpdateRateLimit", cfg.StatusUpdateRateLimit),
+		StatusQueryRateLimit:     getEnvRateLimit("StatusQueryRateLimit", cfg.StatusQueryRateLimit),
+		DefaultRateLimit:         getEnvRateLimit("DefaultRateLimit", cfg.DefaultRateLimit),
+		RateLimitMaxViolations:   getEnvInt("RateLimitMaxViolations", cfg.RateLimitMaxViolations),
+		RateLimitViolationWindow: getEnvSeconds("RateLimitViolationWindowSeconds", cfg.RateLimitViolationWindow),
+
+		VapidPrivateKey:            getEnv("VapidPrivateKey", ""),
+		VapidSubject:               getEnv("VapidSubject", ""),
+		PushTTL:                    getEnvSeconds("PushTTLSeconds", cfg.PushTTL),
+		PushCollapseWindow:         getEnvSeconds("PushCollapseWindowSeconds", cfg.PushCollapseWindow),
+		PushWorkers:                getEnvInt("PushWorkers", cfg.PushWorkers),
+		PushAllowInsecureEndpoints: getEnvBool("PushAllowInsecureEndpoints", false),
+		PushAllowedHosts:           getEnvList("PushAllowedHosts"),
+
+		DebugEventDump: getEnvBool("DebugEventDump", false),
+
+		ShutdownTimeout:         getEnvSeconds("ShutdownTimeoutSeconds", cfg.ShutdownTimeout),
+		ShutdownReconnectJitter: getEnvSeconds("ShutdownReconnectJitterSeconds", cfg.ShutdownReconnectJitter),
+
+		TokenRevalidateInterval: getEnvSeconds("TokenRevalidateIntervalSeconds", cfg.TokenRevalidateInterval),
+
+		ConnectionTicketTTL:  getEnvSeconds("ConnectionTicketTTLSeconds", cfg.ConnectionTicketTTL),
+		AllowLegacyTokenAuth: getEnvBool("AllowLegacyTokenAuth", false),
+
+		AuthTimeout:          getEnvSeconds("AuthTimeoutSeconds", cfg.AuthTimeout),
+		AuthCacheTTL:         getEnvSeconds("AuthCacheTTLSeconds", cfg.AuthCacheTTL),
+		AuthNegativeCacheTTL: getEnvSeconds("AuthNegativeCacheTTLSeconds", cfg.AuthNegativeCacheTTL),
+		AuthBreakerThreshold: getEnvInt("AuthBreakerThreshold", cfg.AuthBreakerThreshold),
+		AuthBreakerCooldown:  getEnvSeconds("AuthBreakerCooldownSeconds", cfg.AuthBreakerCooldown),
+	}
+
+	// A resumed session replays its whole buffer into the new connection's
+	// queue, so the queue must be able to hold it.
+	if cfg.SendQueueSize <= cfg.ReplayBufferSize {
+		cfg.SendQueueSize = cfg.ReplayBufferSize + 64
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Every hub connection owns a bounded outbound queue drained by its own writer
+// goroutine, the same way VcClient.Send works for voice. Producers such as the
+// Redis consumer only ever enqueue; a client that cannot keep up overflows its
+// queue and is disconnected instead of stalling delivery for everyone else.
+
+const (
+	closeSlowConsumer = 4008
+	writeTimeout      = 10 * time.Second
+)
+
+var (
+	errSendQueueFull  = errors.New("send queue full")
+	errConnectionGone = errors.New("connection closed")
+)
+
+type ConnectionQueueStats struct {
+	Depth     int    `json:"depth"`
+	Capacity  int    `json:"capacity"`
+	HighWater int64  `json:"highWater"`
+	Enqueued  uint64 `json:"enqueued"`
+	Sent      uint64 `json:"sent"`
+	BytesSent uint64 `json:"bytesSent"`
+	Overflows uint64 `json:"overflows"`
+}
+
+type connectionMetrics struct {
+	highWater atomic.Int64
+	enqueued  atomic.Uint64
+	sent      atomic.Uint64
+	bytesSent atomic.Uint64
+	overflows atomic.Uint64
+}
+
+func newWSConnection(conn *websocket.Conn, compressor *frameCompressor, wc *wireCodec) *WSConnection {
+	ws := &WSConnection{
+		Conn:       conn,
+		Send:       make(chan []byte, cfg.SendQueueSize),
+		done:       make(chan struct{}),
+		compressor: compressor,
+		codec:      wc,
+	}
+	ws.lastActivity.Store(time.Now().UnixMilli())
+	go ws.writePump()
+	return ws
+}
+
+// enqueue hands a frame to the writer goroutine without blocking.
+func (ws *WSConnection) enqueue(frame []byte) error {
+	select {
+	case <-ws.done:
+		return errConnectionGone
+	default:
+	}
+
+	select {
+	case ws.Send <- frame:
+		ws.metrics.enqueued.Add(1)
+		depth := int64(len(ws.Send))
+		for {
+			high := ws.metrics.highWater.Load()
+			if depth <= high || ws.metrics.highWater.CompareAndSwap(high, depth) {
+				break
+			}
+		}
+		return nil
+	default:
+		ws.metrics.overflows.Add(1)
+		go ws.closeSlowConsumer()
+		return errSendQueueFull
+	}
+}
+
+func (ws *WSConnection) writePump() {
+	for {
+		select {
+		case <-ws.done:
+			return
+		case frame := <-ws.Send:
+			encoded, err := ws.codec.fromJSON(frame)
+			if err != nil {
+				fmt.Println("Error encoding frame as", ws.codec.name+":", err)
+				continue
+			}
+			messageType, data := ws.compressor.encode(ws.codec.messageType(), encoded)
+			_ = ws.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := ws.Conn.WriteMessage(messageType, data); err != nil {
+				ws.close()
+				ws.Conn.Close()
+				return
+			}
+			ws.metrics.sent.Add(1)
+			ws.metrics.bytesSent.Add(uint64(len(frame)))
+		}
+	}
+}
+
+func (ws *WSConnection) closeSlowConsumer() {
+	stats := ws.queueStats()
+	fmt.Printf("Disconnecting slow consumer: queue %d/%d, %d overflows\n", stats.Depth, stats.Capacity, stats.Overflows)
+
+	ws.closeWithCode(closeSlowConsumer, "send queue overflow")
+}
+
+// closeWithCode stops the writer and closes the socket with a close frame
+// carrying code and reason.
+func (ws *WSConnection) closeWithCode(code int, reason string) {
+	ws.close()
+	msg := websocket.FormatCloseMessage(code, reason)
+	_ = ws.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(pingTimeout))
+	ws.Conn.Close()
+}
+
+// close stops the writer goroutine. It is safe to call more than once.
+func (ws *WSConnection) close() {
+	ws.closeOnce.Do(func() {
+		close(ws.done)
+	})
+}
+
+func (ws *WSConnection) queueStats() ConnectionQueueStats {
+	return ConnectionQueueStats{
+		Depth:     len(ws.Send),
+		Capacity:  cap(ws.Send),
+		HighWater: ws.metrics.highWater.Load(),
+		Enqueued:  ws.metrics.enqueued.Load(),
+		Sent:      ws.metrics.sent.Load(),
+		BytesSent: ws.metrics.bytesSent.Load(),
+		Overflows: ws.metrics.overflows.Load(),
+	}
+}
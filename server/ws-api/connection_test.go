@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketPair returns the server and client ends of a real websocket.
+func websocketPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	serverConns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err == nil {
+			serverConns <- conn
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	select {
+	case server := <-serverConns:
+		return server, client
+	case <-time.After(5 * time.Second):
+		t.Fatal("server side of the websocket never arrived")
+		return nil, nil
+	}
+}
+
+func TestDeliverLocalLeavesSlowConsumerCloseToTheQueue(t *testing.T) {
+	server, client := websocketPair(t)
+
+	// No writer goroutine, so the queue stays full.
+	ws := &WSConnection{Conn: server, Send: make(chan []byte, 1), done: make(chan struct{})}
+	ws.Send <- []byte(`{}`)
+	hub.lock.Lock()
+	hub.clients["slow"] = []*WSConnection{ws}
+	hub.lock.Unlock()
+	t.Cleanup(func() {
+		hub.lock.Lock()
+		delete(hub.clients, "slow")
+		hub.lock.Unlock()
+	})
+
+	deliverLocal("MESSAGE", map[string]string{"text": "hi"}, []string{"slow"})
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := client.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != closeSlowConsumer {
+		t.Fatalf("client read %v, want close %d", err, closeSlowConsumer)
+	}
+}
+
+func TestRegisterClientKeepsRedisOutOfHubLock(t *testing.T) {
+	f := startFakeRedis(t)
+	previousCluster := *cluster
+	t.Cleanup(func() { *cluster = previousCluster })
+	cluster.enabled = true
+	cluster.nodeID = "node-a"
+	// Invisible users are not broadcast, so nothing outlives the test.
+	redisClient.HSet(ctx, presencePrefix+"joining", "status", string(StatusInvisible))
+
+	server, _ := websocketPair(t)
+	compressor := newFrameCompressor(httptest.NewRequest(http.MethodGet, "/ws", nil), server)
+
+	// Block every Redis command, then connect.
+	f.mu.Lock()
+	registered := make(chan *WSConnection, 1)
+	go func() {
+		registered <- registerClient("joining", "token", server, compressor, jsonCodec, protocolVersion)
+	}()
+
+	// Well inside the client's read timeout, after which a blocked command
+	// would fail and release whatever it held.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if hub.lock.TryRLock() {
+			_, listed := hub.clients["joining"]
+			hub.lock.RUnlock()
+			if listed {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			f.mu.Unlock()
+			t.Fatal("client never reached the hub while Redis was blocked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !hub.lock.TryLock() {
+		f.mu.Unlock()
+		t.Fatal("hub.lock is held across a Redis call")
+	}
+	hub.lock.Unlock()
+	f.mu.Unlock()
+
+	ws := <-registered
+	t.Cleanup(func() {
+		hub.lock.Lock()
+		delete(hub.clients, "joining")
+		hub.lock.Unlock()
+		sessions.remove(ws.session())
+		ws.close()
+	})
+	if got := redisClient.HGet(ctx, clusterNodeSessionPrefix+"node-a", ws.session().ID).Val(); got != "joining" {
+		t.Fatalf("session registered for %q", got)
+	}
+}
@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/json"
 	"log"
-
-	"github.com/gorilla/websocket"
 )
 
 func buildSignalData(p DataPayload) []byte {
@@ -37,10 +35,34 @@ func sendEnvelope(client *VcClient, event string, data interface{}) {
 		Data:  mustJSON(data),
 	}
 	msg, _ := json.Marshal(envelope)
+	if !client.queue(msg) {
+		log.Println("[WS] Failed to send", event, "to", client.ID, "(channel full or closed)")
+	}
+}
+
+// queue hands msg to the client's writer without blocking. It reports false
+// when the queue is full or the client is already gone.
+func (c *VcClient) queue(msg []byte) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendClosed {
+		return false
+	}
 	select {
-	case client.Send <- msg:
+	case c.Send <- msg:
+		return true
 	default:
-		log.Println("[WS] Failed to send", event, "to", client.ID, "(channel full or closed)")
+		return false
+	}
+}
+
+// closeSend stops the client's writer. It is safe to call more than once.
+func (c *VcClient) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.Send)
 	}
 }
 
@@ -58,32 +80,50 @@ func forwardData(fromID, targetID string, signalDataJSON []byte) {
 	}
 	envelopeJSON, _ := json.Marshal(envelope)
 
+	if deliverVoiceLocal(targetID, envelopeJSON) {
+		return
+	}
+	if cluster.forwardVoice(targetID, envelopeJSON) {
+		log.Println("[WS] Forwarded data to", targetID, "through the cluster")
+		return
+	}
+	log.Println("[WS] Target client not found:", targetID)
+}
+
+// deliverVoiceLocal queues an envelope for a voice client held by this node.
+func deliverVoiceLocal(targetID string, envelopeJSON []byte) bool {
 	vcHub.mu.RLock()
 	targetClient, exists := vcHub.clients[targetID]
 	vcHub.mu.RUnlock()
 	if !exists {
-		log.Println("[WS] Target client not found:", targetID)
-		return
+		return false
 	}
 
-	select {
-	case targetClient.Send <- envelopeJSON:
+	if targetClient.queue(envelopeJSON) {
 		log.Println("[WS] Forwarded data to", targetID)
-	default:
+	} else {
 		log.Println("[WS] Failed to send to", targetID, "- channel full or closed")
 	}
+	return true
 }
 
 func cleanupConnection(client *VcClient) {
 	cleanupClient(client)
-	close(client.Send)
+	cluster.unregisterVoiceClient(client.ID)
+	client.closeSend()
 	client.Conn.Close()
 	log.Println("[WS] Client disconnected:", client.ID)
 }
 
 func clientWriter(client *VcClient) {
 	for msg := range client.Send {
-		if err := client.Conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		encoded, err := client.codec.fromJSON(msg)
+		if err != nil {
+			log.Println("[WS] Failed to encode frame for", client.ID, ":", err)
+			continue
+		}
+		messageType, data := client.compressor.encode(client.codec.messageType(), encoded)
+		if err := client.Conn.WriteMessage(messageType, data); err != nil {
 			log.Println("[WS] Write error for", client.ID, ":", err)
 			break
 		}
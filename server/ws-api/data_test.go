@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestVoiceSendAfterClose(t *testing.T) {
+	client := &VcClient{ID: "voice-1", Send: make(chan []byte, 1)}
+	vcHub.mu.Lock()
+	vcHub.clients[client.ID] = client
+	vcHub.mu.Unlock()
+	t.Cleanup(func() {
+		vcHub.mu.Lock()
+		delete(vcHub.clients, client.ID)
+		vcHub.mu.Unlock()
+	})
+
+	if !client.queue([]byte(`{}`)) {
+		t.Fatal("first frame was not queued")
+	}
+	if client.queue([]byte(`{}`)) {
+		t.Fatal("frame queued past the queue size")
+	}
+	<-client.Send
+
+	client.closeSend()
+	client.closeSend()
+	if client.queue([]byte(`{}`)) {
+		t.Fatal("frame queued after close")
+	}
+	// Neither may panic on the closed channel.
+	sendEnvelope(client, "pong", map[string]string{})
+	if !deliverVoiceLocal(client.ID, []byte(`{}`)) {
+		t.Fatal("registered client was not found")
+	}
+	if _, open := <-client.Send; open {
+		t.Fatal("Send is still open")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Every hub connection belongs to a device class taken from the platform it
+// reported in IDENTIFY. Each node keeps the devices of its own connections in
+//
+//	presence_devices:{userId}  hash of nodeId -> {platform: last activity in unix ms}
+//
+// and presence responses carry a clientStatus map built from all of them, so
+// a user on desktop and phone can be shown as online on desktop and idle on
+// mobile.
+
+const (
+	presenceDevicesPrefix = "presence_devices:"
+
+	PlatformDesktop = "desktop"
+	PlatformMobile  = "mobile"
+	PlatformWeb     = "web"
+)
+
+// devicePlatform maps the platform a client reported to a device class.
+func devicePlatform(reported string) string {
+	switch strings.ToLower(reported) {
+	case "desktop", "electron", "windows", "macos", "darwin", "linux":
+		return PlatformDesktop
+	case "mobile", "ios", "android", "ipados":
+		return PlatformMobile
+	default:
+		return PlatformWeb
+	}
+}
+
+// deviceSet is this node's record of which device classes each user has, so
+// connects and disconnects only broadcast when the set actually changes.
+type deviceSet struct {
+	mu        sync.Mutex
+	platforms map[string]string
+}
+
+var devices = &deviceSet{platforms: make(map[string]string)}
+
+// localDevices returns the latest activity per device class across the
+// user's connections on this node.
+func localDevices(userId string) map[string]int64 {
+	hub.lock.RLock()
+	conns := append([]*WSConnection(nil), hub.clients[userId]...)
+	hub.lock.RUnlock()
+
+	now := time.Now()
+	result := make(map[string]int64, len(conns))
+	for _, ws := range conns {
+		platform := devicePlatform(ws.clientProperties().Platform)
+		if at := ws.activityAt(now); at > result[platform] {
+			result[platform] = at
+		}
+	}
+	return result
+}
+
+func platformSignature(platforms map[string]int64) string {
+	names := make([]string, 0, len(platforms))
+	for platform := range platforms {
+		names = append(names, platform)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// writeDevices queues this node's devices for the user on pipe.
+func writeDevices(pipe redis.Pipeliner, userId string, local map[string]int64) {
+	key := presenceDevicesPrefix + userId
+	if len(local) == 0 {
+		pipe.HDel(ctx, key, cfg.NodeID)
+		return
+	}
+	pipe.HSet(ctx, key, cfg.NodeID, []byte(mustJSON(local)))
+	pipe.Expire(ctx, key, cfg.PresenceTTL)
+}
+
+// sync stores the user's devices on this node and broadcasts the new presence
+// when a device class appeared or went away.
+func (d *deviceSet) sync(userId string) {
+	local := localDevices(userId)
+	signature := platformSignature(local)
+
+	d.mu.Lock()
+	previous, known := d.platforms[userId]
+	if len(local) == 0 {
+		delete(d.platforms, userId)
+	} else {
+		d.platforms[userId] = signature
+	}
+	d.mu.Unlock()
+
+	pipe := redisClient.Pipeline()
+	writeDevices(pipe, userId, local)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error saving devices", err)
+		return
+	}
+
+	if !known || previous == signature {
+		return
+	}
+	// With no devices left here the disconnect timer reports the user
+	// offline, unless they are still connected through another node.
+	if len(local) == 0 {
+		if remaining, err := redisClient.HLen(ctx, presenceDevicesPrefix+userId).Result(); err != nil || remaining == 0 {
+			return
+		}
+	}
+	go broadcastPresenceChange(userId)
+}
+
+// clientStatuses combines the per-node device records into a status per
+// device class. With a chosen online status each device is online or idle by
+// its own activity; any other chosen status applies to every device.
+func clientStatuses(nodeDevices []string, chosen UserStatus, now time.Time) map[string]UserStatus {
+	if chosen == StatusOffline {
+		return nil
+	}
+
+	latest := make(map[string]int64)
+	for _, raw := range nodeDevices {
+		var platforms map[string]int64
+		if json.Unmarshal([]byte(raw), &platforms) != nil {
+			continue
+		}
+		for platform, at := range platforms {
+			if at > latest[platform] {
+				latest[platform] = at
+			}
+		}
+	}
+	if len(latest) == 0 {
+		return nil
+	}
+
+	cutoff := now.Add(-cfg.IdleTimeout).UnixMilli()
+	result := make(map[string]UserStatus, len(latest))
+	for platform, at := range latest {
+		switch {
+		case chosen != StatusOnline:
+			result[platform] = chosen
+		case at < cutoff:
+			result[platform] = StatusIdle
+		default:
+			result[platform] = StatusOnline
+		}
+	}
+	return result
+}
+
+func clientStatusSignature(statuses map[string]UserStatus) string {
+	parts := make([]string, 0, len(statuses))
+	for platform, status := range statuses {
+		parts = append(parts, platform+"="+string(status))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
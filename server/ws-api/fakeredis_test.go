@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// fakeRedis is a small in-memory RESP server with the commands the tests
+// exercise, so they run without a Redis instance. Expirations are accepted
+// but not enforced.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]struct{}
+	streams map[string]*fakeStream
+
+	// published holds every PUBLISH payload by channel. Sorted sets are not
+	// modelled; ZADD and ZREM are accepted and ignored.
+	published map[string][]string
+
+	// failing makes the named commands answer with an error. Set it with
+	// fail.
+	failing map[string]bool
+}
+
+type fakeStream struct {
+	entries []fakeStreamEntry
+	nextSeq int
+	groups  map[string]*fakeGroup
+}
+
+type fakeGroup struct {
+	lastDelivered string
+	pending       map[string]*fakePending
+}
+
+type fakeStreamEntry struct {
+	id     string
+	fields []string
+}
+
+type fakePending struct {
+	consumer   string
+	deliveries int
+}
+
+type statusReply string
+
+var errFakeUnknownCommand = errors.New("ERR unknown command")
+
+// startFakeRedis points redisClient at a fresh fake for the test's duration.
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		strings:   make(map[string]string),
+		hashes:    make(map[string]map[string]string),
+		sets:      make(map[string]map[string]struct{}),
+		streams:   make(map[string]*fakeStream),
+		published: make(map[string][]string),
+		failing:   make(map[string]bool),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	previous := redisClient
+	redisClient = redis.NewClient(&redis.Options{Addr: ln.Addr().String()})
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = previous
+		ln.Close()
+	})
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		switch strings.ToUpper(args[0]) {
+		case "MULTI":
+			inMulti, queued = true, nil
+			writeReply(w, statusReply("OK"))
+		case "EXEC":
+			replies := make([]interface{}, 0, len(queued))
+			for _, cmd := range queued {
+				replies = append(replies, f.exec(cmd))
+			}
+			inMulti, queued = false, nil
+			writeReply(w, replies)
+		default:
+			if inMulti {
+				queued = append(queued, args)
+				writeReply(w, statusReply("QUEUED"))
+			} else {
+				writeReply(w, f.exec(args))
+			}
+		}
+		if r.Buffered() == 0 {
+			w.Flush()
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("expected array")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case statusReply:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", v.Error())
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(item), item)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	}
+}
+
+func (f *fakeRedis) exec(args []string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cmd, args := strings.ToUpper(args[0]), args[1:]
+	if f.failing[cmd] {
+		return errors.New("ERR injected failure")
+	}
+	switch cmd {
+	case "PING":
+		return statusReply("PONG")
+	case "GET":
+		if v, ok := f.strings[args[0]]; ok {
+			return v
+		}
+		return nil
+	case "SET":
+		_, exists := f.strings[args[0]]
+		for _, option := range args[2:] {
+			if strings.EqualFold(option, "NX") && exists {
+				return nil
+			}
+		}
+		f.strings[args[0]] = args[1]
+		return statusReply("OK")
+	case "DEL":
+		removed := 0
+		for _, key := range args {
+			if f.delete(key) {
+				removed++
+			}
+		}
+		return removed
+	case "EXISTS":
+		found := 0
+		for _, key := range args {
+			if f.exists(key) {
+				found++
+			}
+		}
+		return found
+	case "PUBLISH":
+		f.published[args[0]] = append(f.published[args[0]], args[1])
+		return 0
+	case "ZADD", "ZREM":
+		return 0
+	case "XADD":
+		stream := f.stream(args[0])
+		stream.nextSeq++
+		id := "1-" + strconv.Itoa(stream.nextSeq)
+		stream.entries = append(stream.entries, fakeStreamEntry{id: id, fields: args[2:]})
+		return id
+	case "XGROUP":
+		stream := f.stream(args[1])
+		if _, ok := stream.groups[args[2]]; ok {
+			return errors.New("BUSYGROUP Consumer Group name already exists")
+		}
+		start := args[3]
+		if start == "$" {
+			start = "0-0"
+			if n := len(stream.entries); n > 0 {
+				start = stream.entries[n-1].id
+			}
+		}
+		stream.groups[args[2]] = &fakeGroup{lastDelivered: start, pending: make(map[string]*fakePending)}
+		return statusReply("OK")
+	case "XREADGROUP":
+		return f.xreadgroup(args)
+	case "XPENDING":
+		group := f.stream(args[0]).groups[args[1]]
+		consumer := ""
+		if len(args) > 5 {
+			consumer = args[5]
+		}
+		var reply []interface{}
+		for _, entry := range f.stream(args[0]).entries {
+			p, ok := group.pending[entry.id]
+			if !ok || (consumer != "" && p.consumer != consumer) ||
+				compareStreamIDs(entry.id, args[2]) < 0 || compareStreamIDs(entry.id, args[3]) > 0 {
+				continue
+			}
+			reply = append(reply, []interface{}{entry.id, p.consumer, 0, p.deliveries})
+		}
+		return reply
+	case "XACK":
+		acked := 0
+		for _, id := range args[2:] {
+			if group, ok := f.stream(args[0]).groups[args[1]]; ok {
+				if _, ok := group.pending[id]; ok {
+					delete(group.pending, id)
+					acked++
+				}
+			}
+		}
+		return acked
+	case "SCAN":
+		pattern := "*"
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.EqualFold(args[i], "MATCH") {
+				pattern = args[i+1]
+			}
+		}
+		keys := []string{}
+		for _, key := range f.keys() {
+			if ok, _ := path.Match(pattern, key); ok {
+				keys = append(keys, key)
+			}
+		}
+		return []interface{}{"0", keys}
+	case "EXPIRE", "PEXPIRE":
+		return 1
+	case "HSET":
+		h, ok := f.hashes[args[0]]
+		if !ok {
+			h = make(map[string]string)
+			f.hashes[args[0]] = h
+		}
+		added := 0
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				added++
+			}
+			h[args[i]] = args[i+1]
+		}
+		return added
+	case "HGET":
+		if v, ok := f.hashes[args[0]][args[1]]; ok {
+			return v
+		}
+		return nil
+	case "HGETALL":
+		h := f.hashes[args[0]]
+		fields := make([]string, 0, len(h))
+		for field := range h {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		out := make([]string, 0, 2*len(h))
+		for _, field := range fields {
+			out = append(out, field, h[field])
+		}
+		return out
+	case "HINCRBY":
+		h, ok := f.hashes[args[0]]
+		if !ok {
+			h = make(map[string]string)
+			f.hashes[args[0]] = h
+		}
+		current, _ := strconv.Atoi(h[args[1]])
+		by, _ := strconv.Atoi(args[2])
+		h[args[1]] = strconv.Itoa(current + by)
+		return current + by
+	case "HMGET":
+		values := make([]interface{}, 0, len(args)-1)
+		for _, field := range args[1:] {
+			if v, ok := f.hashes[args[0]][field]; ok {
+				values = append(values, v)
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values
+	case "HVALS":
+		h := f.hashes[args[0]]
+		fields := make([]string, 0, len(h))
+		for field := range h {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		values := make([]string, 0, len(h))
+		for _, field := range fields {
+			values = append(values, h[field])
+		}
+		return values
+	case "HDEL":
+		removed := 0
+		for _, field := range args[1:] {
+			if _, ok := f.hashes[args[0]][field]; ok {
+				delete(f.hashes[args[0]], field)
+				removed++
+			}
+		}
+		if len(f.hashes[args[0]]) == 0 {
+			delete(f.hashes, args[0])
+		}
+		return removed
+	case "HLEN":
+		return len(f.hashes[args[0]])
+	case "HEXISTS":
+		if _, ok := f.hashes[args[0]][args[1]]; ok {
+			return 1
+		}
+		return 0
+	case "SADD":
+		s, ok := f.sets[args[0]]
+		if !ok {
+			s = make(map[string]struct{})
+			f.sets[args[0]] = s
+		}
+		added := 0
+		for _, member := range args[1:] {
+			if _, ok := s[member]; !ok {
+				s[member] = struct{}{}
+				added++
+			}
+		}
+		return added
+	case "SREM":
+		removed := 0
+		for _, member := range args[1:] {
+			if _, ok := f.sets[args[0]][member]; ok {
+				delete(f.sets[args[0]], member)
+				removed++
+			}
+		}
+		if len(f.sets[args[0]]) == 0 {
+			delete(f.sets, args[0])
+		}
+		return removed
+	case "SISMEMBER":
+		if _, ok := f.sets[args[0]][args[1]]; ok {
+			return 1
+		}
+		return 0
+	case "SCARD":
+		return len(f.sets[args[0]])
+	case "SMEMBERS":
+		members := make([]string, 0, len(f.sets[args[0]]))
+		for member := range f.sets[args[0]] {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		return members
+	}
+	return errFakeUnknownCommand
+}
+
+func (f *fakeRedis) stream(key string) *fakeStream {
+	stream, ok := f.streams[key]
+	if !ok {
+		stream = &fakeStream{groups: make(map[string]*fakeGroup)}
+		f.streams[key] = stream
+	}
+	return stream
+}
+
+func (f *fakeRedis) messages(channel string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.published[channel]...)
+}
+
+func (f *fakeRedis) fail(cmd string, failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[cmd] = failing
+}
+
+func (f *fakeRedis) streamEntries(key string) []fakeStreamEntry {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeStreamEntry(nil), f.stream(key).entries...)
+}
+
+// xreadgroup serves XREADGROUP GROUP g c [COUNT n] [BLOCK ms] STREAMS key id
+// for a single stream, without blocking.
+func (f *fakeRedis) xreadgroup(args []string) interface{} {
+	group, consumer := args[1], args[2]
+	count := 0
+	var key, start string
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			count, _ = strconv.Atoi(args[i+1])
+			i++
+		case "BLOCK":
+			i++
+		case "STREAMS":
+			key, start = args[i+1], args[i+2]
+			i = len(args)
+		}
+	}
+	stream := f.stream(key)
+	g, ok := stream.groups[group]
+	if !ok {
+		return errors.New("NOGROUP No such consumer group")
+	}
+
+	var messages []interface{}
+	for _, entry := range stream.entries {
+		if count > 0 && len(messages) == count {
+			break
+		}
+		p, isPending := g.pending[entry.id]
+		if start == ">" {
+			if compareStreamIDs(entry.id, g.lastDelivered) <= 0 {
+				continue
+			}
+			g.lastDelivered = entry.id
+			g.pending[entry.id] = &fakePending{consumer: consumer, deliveries: 1}
+		} else {
+			if !isPending || p.consumer != consumer || compareStreamIDs(entry.id, start) <= 0 {
+				continue
+			}
+			p.deliveries++
+		}
+		fields := make([]interface{}, len(entry.fields))
+		for i, field := range entry.fields {
+			fields[i] = field
+		}
+		messages = append(messages, []interface{}{entry.id, fields})
+	}
+	if start == ">" && len(messages) == 0 {
+		return nil
+	}
+	return []interface{}{[]interface{}{key, messages}}
+}
+
+// compareStreamIDs orders "ms-seq" stream IDs; "0", "-" and "+" are bounds.
+func compareStreamIDs(a, b string) int {
+	parse := func(id string) (int, int) {
+		switch id {
+		case "-":
+			return 0, 0
+		case "+":
+			return int(^uint(0) >> 1), 0
+		}
+		ms, seq, _ := strings.Cut(id, "-")
+		m, _ := strconv.Atoi(ms)
+		n, _ := strconv.Atoi(seq)
+		return m, n
+	}
+	am, as := parse(a)
+	bm, bs := parse(b)
+	switch {
+	case am != bm:
+		return am - bm
+	default:
+		return as - bs
+	}
+}
+
+func (f *fakeRedis) keys() []string {
+	var keys []string
+	for key := range f.strings {
+		keys = append(keys, key)
+	}
+	for key := range f.hashes {
+		keys = append(keys, key)
+	}
+	for key := range f.sets {
+		keys = append(keys, key)
+	}
+	for key := range f.streams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeRedis) exists(key string) bool {
+	_, inStrings := f.strings[key]
+	_, inHashes := f.hashes[key]
+	_, inSets := f.sets[key]
+	return inStrings || inHashes || inSets
+}
+
+func (f *fakeRedis) delete(key string) bool {
+	found := f.exists(key)
+	delete(f.strings, key)
+	delete(f.hashes, key)
+	delete(f.sets, key)
+	return found
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -17,24 +18,23 @@ type VideoUserStatus struct {
 func HandleWS(w http.ResponseWriter, r *http.Request) {
 	enableCORS(w, r)
 
-	token := extractToken(r)
-	if token == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
+	userID, token, header, err := authenticateUpgrade(r)
+	if err != nil {
+		status := authStatus(err)
+		http.Error(w, http.StatusText(status)+": "+err.Error(), status)
 		return
 	}
 
-	userID, err := authenticateSession(token)
+	conn, err := vcUpgrader.Upgrade(w, r, header)
 	if err != nil {
-		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 		return
 	}
-
-	conn, err := upgradeConnection(w, r)
-	if err != nil {
+	if _, supported := negotiateProtocolVersion(r); !supported {
+		closeUnsupportedVersion(conn)
 		return
 	}
 
-	client := registerClientVC(userID, conn)
+	client := registerClientVC(userID, token, conn, newFrameCompressor(r, conn), codecForRequest(r))
 	defer cleanupConnection(client)
 
 	existing := buildExistingUserList(userID)
@@ -126,20 +126,25 @@ func emitUserList(c *VcClient) {
 		RtcUserId: c.ID,
 	}
 
-	sendJSON(c.Conn, Envelope{Event: "userList", Data: mustJSON(payload)})
+	sendEnvelope(c, "userList", payload)
 }
 
-func registerClientVC(userID string, conn *websocket.Conn) *VcClient {
+func registerClientVC(userID, token string, conn *websocket.Conn, compressor *frameCompressor, wc *wireCodec) *VcClient {
 	client := &VcClient{
-		ID:   userID,
-		Conn: conn,
-		Send: make(chan []byte, 256),
+		ID:         userID,
+		Conn:       conn,
+		Send:       make(chan []byte, 256),
+		token:      token,
+		compressor: compressor,
+		codec:      wc,
 	}
+	client.lastActivity.Store(time.Now().UnixMilli())
 
 	vcHub.mu.Lock()
 	vcHub.clients[userID] = client
 	vcHub.mu.Unlock()
 
+	cluster.registerVoiceClient(userID)
 	return client
 }
 
@@ -151,9 +156,12 @@ func handleClientMessages(client *VcClient) {
 		}
 
 		var env Envelope
-		if err := json.Unmarshal(msg, &env); err != nil {
+		if err := client.codec.decode(msg, &env); err != nil {
 			continue
 		}
+		if env.Event != "ping" {
+			noteVoiceActivity(client)
+		}
 
 		switch env.Event {
 		case "joinRoom":
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Every /ws connection starts with HELLO, which tells the client how often to
+// send HEARTBEAT and which protocol version was negotiated (see protocol.go).
+// The client answers with IDENTIFY describing itself. Each HEARTBEAT is
+// acknowledged with the round trip of the server's last websocket ping, and a
+// connection that sends neither heartbeats nor pongs for MaxMissedHeartbeats
+// intervals is closed as a zombie.
+
+const closeHeartbeatTimeout = 4009
+
+type HelloResponse struct {
+	HeartbeatInterval  int64 `json:"heartbeatInterval"`
+	ProtocolVersion    int   `json:"protocolVersion"`
+	MinProtocolVersion int   `json:"minProtocolVersion"`
+}
+
+type ClientProperties struct {
+	Platform      string   `json:"platform"`
+	ClientVersion string   `json:"clientVersion"`
+	Capabilities  []string `json:"capabilities"`
+}
+
+type HeartbeatPayload struct {
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// HeartbeatAckResponse carries PingRttMs, the round trip of the last ping the
+// server sent and the client answered with a pong. It is not the time the
+// HEARTBEAT itself took; clients measure that between sending it and the ACK.
+type HeartbeatAckResponse struct {
+	Nonce      string `json:"nonce,omitempty"`
+	PingRttMs  int64  `json:"pingRttMs"`
+	ServerTime int64  `json:"serverTime"`
+}
+
+func sendHello(ws *WSConnection) {
+	ws.touch()
+	ws.Conn.SetPongHandler(func(appData string) error {
+		ws.touch()
+		if len(appData) == 8 {
+			sentAt := int64(binary.BigEndian.Uint64([]byte(appData)))
+			ws.pingRtt.Store(time.Now().UnixNano() - sentAt)
+		}
+		return nil
+	})
+
+	writeToConn(ws, "HELLO", HelloResponse{
+		HeartbeatInterval:  cfg.HeartbeatInterval.Milliseconds(),
+		ProtocolVersion:    ws.version,
+		MinProtocolVersion: minProtocolVersion,
+	})
+}
+
+func handleIdentify(conn *websocket.Conn, event EventMessage, userId string) {
+	var props ClientProperties
+	if err := unmarshalPayload(event, &props); err != nil {
+		rejectEvent(conn, userId, event, errorInvalidPayload, err)
+		return
+	}
+
+	ws := findConnection(userId, conn)
+	if ws == nil {
+		return
+	}
+
+	props.Platform = strings.ToLower(strings.TrimSpace(props.Platform))
+	ws.Mutex.Lock()
+	ws.Client = props
+	ws.Mutex.Unlock()
+	ws.touch()
+	devices.sync(userId)
+}
+
+func handleHeartbeat(conn *websocket.Conn, event EventMessage, userId string) {
+	var payload HeartbeatPayload
+	_ = unmarshalPayload(event, &payload)
+
+	ws := findConnection(userId, conn)
+	if ws == nil {
+		return
+	}
+	ws.touch()
+
+	writeToConn(ws, "HEARTBEAT_ACK", HeartbeatAckResponse{
+		Nonce:      payload.Nonce,
+		PingRttMs:  ws.pingRttMs(),
+		ServerTime: time.Now().UnixMilli(),
+	})
+}
+
+func (ws *WSConnection) touch() {
+	ws.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (ws *WSConnection) pingRttMs() int64 {
+	return time.Duration(ws.pingRtt.Load()).Milliseconds()
+}
+
+func (ws *WSConnection) clientProperties() ClientProperties {
+	ws.Mutex.Lock()
+	defer ws.Mutex.Unlock()
+	return ws.Client
+}
+
+// isZombie reports whether the connection has been silent for longer than the
+// allowed number of heartbeat intervals.
+func (ws *WSConnection) isZombie(now time.Time) bool {
+	lastSeen := time.Unix(0, ws.lastSeen.Load())
+	return now.Sub(lastSeen) > cfg.HeartbeatInterval*time.Duration(cfg.MaxMissedHeartbeats)
+}
+
+func closeZombie(ws *WSConnection) {
+	ws.closeWithCode(closeHeartbeatTimeout, "heartbeat timeout")
+}
+
+func pingPayload(now time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(now.UnixNano()))
+	return b
+}
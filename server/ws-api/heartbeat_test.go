@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatAckReportsPingRoundTrip(t *testing.T) {
+	server, _ := websocketPair(t)
+	ws := &WSConnection{Conn: server, Send: make(chan []byte, 1), done: make(chan struct{})}
+	ws.pingRtt.Store(int64(42 * time.Millisecond))
+	hub.lock.Lock()
+	hub.clients["beating"] = []*WSConnection{ws}
+	hub.lock.Unlock()
+	t.Cleanup(func() {
+		hub.lock.Lock()
+		delete(hub.clients, "beating")
+		hub.lock.Unlock()
+	})
+
+	payload, _ := json.Marshal(HeartbeatPayload{Nonce: "n-1"})
+	handleHeartbeat(server, EventMessage{EventType: "HEARTBEAT", Payload: payload}, "beating")
+
+	var frame struct {
+		EventType string                     `json:"event_type"`
+		Payload   map[string]json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(<-ws.Send, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.EventType != "HEARTBEAT_ACK" {
+		t.Fatalf("event type = %q", frame.EventType)
+	}
+	if got := string(frame.Payload["pingRttMs"]); got != "42" {
+		t.Errorf("pingRttMs = %s, want 42", got)
+	}
+	if got := string(frame.Payload["nonce"]); got != `"n-1"` {
+		t.Errorf("nonce = %s", got)
+	}
+	if _, ok := frame.Payload["latencyMs"]; ok {
+		t.Error("ack still carries latencyMs")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+// Users go idle when none of their devices has shown activity for
+// IdleTimeout. Activity is an ACTIVITY ping, typing, or any voice event on
+// /video-ws. Each node writes the latest activity of its own connections to
+//
+//	presence_active:{userId}  hash of nodeId -> last activity in unix ms
+//
+// so devices on different nodes are combined the same way presence_live
+// combines connections. Idle is only applied on top of a chosen online status
+// and is kept in the idle field of presence:{userId}; DND and invisible are
+// never overwritten.
+//
+// Only clients that list the "activity" capability in IDENTIFY send ACTIVITY.
+// Any other /ws connection counts as active for as long as it is open, so
+// clients that never report activity are not shown as idle.
+
+const (
+	presenceActivePrefix = "presence_active:"
+	capabilityActivity   = "activity"
+
+	idleCheckInterval = 15 * time.Second
+)
+
+type activityTracker struct {
+	mu   sync.Mutex
+	idle map[string]bool
+}
+
+var activity = &activityTracker{idle: make(map[string]bool)}
+
+func handleActivity(conn *websocket.Conn, event EventMessage, userId string) {
+	noteActivity(userId, conn)
+}
+
+// noteActivity records activity on one of the user's hub connections.
+func noteActivity(userId string, conn *websocket.Conn) {
+	ws := findConnection(userId, conn)
+	if ws == nil {
+		return
+	}
+	ws.lastActivity.Store(time.Now().UnixMilli())
+	activity.wake(userId)
+}
+
+// noteVoiceActivity records activity on the user's voice connection.
+func noteVoiceActivity(client *VcClient) {
+	client.lastActivity.Store(time.Now().UnixMilli())
+	activity.wake(client.ID)
+}
+
+// wake brings a user this node announced as idle back online straight away
+// instead of waiting for the next check.
+func (t *activityTracker) wake(userId string) {
+	t.mu.Lock()
+	idle := t.idle[userId]
+	delete(t.idle, userId)
+	t.mu.Unlock()
+	if !idle {
+		return
+	}
+
+	pipe := redisClient.Pipeline()
+	pipe.HSet(ctx, presenceActivePrefix+userId, cfg.NodeID, time.Now().UnixMilli())
+	pipe.Expire(ctx, presenceActivePrefix+userId, cfg.PresenceTTL)
+	pipe.HSet(ctx, presencePrefix+userId, "idle", "0")
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error clearing idle status", err)
+		return
+	}
+	go broadcastPresenceChange(userId)
+}
+
+// forget drops the cached idle flag.
+func (t *activityTracker) forget(userId string) {
+	t.mu.Lock()
+	delete(t.idle, userId)
+	t.mu.Unlock()
+}
+
+// reset clears the idle flag without announcing it, for callers that
+// broadcast the user's status themselves.
+func (t *activityTracker) reset(userId string) {
+	t.forget(userId)
+	if err := redisClient.HSet(ctx, presencePrefix+userId, "idle", "0").Err(); err != nil {
+		logErr("Error clearing idle status", err)
+	}
+}
+
+// activityAt returns the connection's latest activity in unix ms, or now for
+// a client that does not report activity.
+func (ws *WSConnection) activityAt(now time.Time) int64 {
+	if !ws.reportsActivity() {
+		return now.UnixMilli()
+	}
+	return ws.lastActivity.Load()
+}
+
+func (ws *WSConnection) reportsActivity() bool {
+	for _, capability := range ws.clientProperties().Capabilities {
+		if capability == capabilityActivity {
+			return true
+		}
+	}
+	return false
+}
+
+// localActivity returns the latest activity across the user's connections on
+// this node, in unix ms.
+func localActivity(userId string) int64 {
+	var latest int64
+	now := time.Now()
+
+	hub.lock.RLock()
+	for _, ws := range hub.clients[userId] {
+		if at := ws.activityAt(now); at > latest {
+			latest = at
+		}
+	}
+	hub.lock.RUnlock()
+
+	vcHub.mu.RLock()
+	if client, ok := vcHub.clients[userId]; ok {
+		if at := client.lastActivity.Load(); at > latest {
+			latest = at
+		}
+	}
+	vcHub.mu.RUnlock()
+
+	return latest
+}
+
+func localActiveUsers() []string {
+	seen := make(map[string]struct{})
+	var userIds []string
+
+	hub.lock.RLock()
+	for userId := range hub.clients {
+		seen[userId] = struct{}{}
+		userIds = append(userIds, userId)
+	}
+	hub.lock.RUnlock()
+
+	vcHub.mu.RLock()
+	for userId := range vcHub.clients {
+		if _, ok := seen[userId]; !ok {
+			userIds = append(userIds, userId)
+		}
+	}
+	vcHub.mu.RUnlock()
+
+	return userIds
+}
+
+type idleCheck struct {
+	userId   string
+	activity *redis.StringSliceCmd
+	devices  *redis.StringSliceCmd
+	state    *redis.SliceCmd
+	live     *redis.StringSliceCmd
+}
+
+// checkIdle publishes this node's activity for every local user and moves
+// users between online and idle when their combined activity says so. It
+// also broadcasts when a single device went idle or came back, which shows up
+// only in clientStatus.
+func (t *activityTracker) checkIdle(now time.Time) {
+	userIds := localActiveUsers()
+	if len(userIds) == 0 {
+		return
+	}
+
+	pipe := redisClient.Pipeline()
+	checks := make([]idleCheck, 0, len(userIds))
+	for _, userId := range userIds {
+		if at := localActivity(userId); at > 0 {
+			pipe.HSet(ctx, presenceActivePrefix+userId, cfg.NodeID, at)
+			pipe.Expire(ctx, presenceActivePrefix+userId, cfg.PresenceTTL)
+		}
+		if local := localDevices(userId); len(local) > 0 {
+			writeDevices(pipe, userId, local)
+		}
+		checks = append(checks, idleCheck{
+			userId:   userId,
+			activity: pipe.HVals(ctx, presenceActivePrefix+userId),
+			devices:  pipe.HVals(ctx, presenceDevicesPrefix+userId),
+			state:    pipe.HMGet(ctx, presencePrefix+userId, "status", "idle", "clientStatusSig"),
+			live:     pipe.HVals(ctx, presenceLivePrefix+userId),
+		})
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		logErr("Error checking idle users", err)
+		return
+	}
+
+	cutoff := now.Add(-cfg.IdleTimeout).UnixMilli()
+	for _, check := range checks {
+		var latest int64
+		for _, value := range check.activity.Val() {
+			if at, err := strconv.ParseInt(value, 10, 64); err == nil && at > latest {
+				latest = at
+			}
+		}
+
+		state := check.state.Val()
+		if len(state) != 3 {
+			continue
+		}
+		chosen, _ := state[0].(string)
+		storedIdle, _ := state[1].(string)
+		storedClients, _ := state[2].(string)
+		if !isLive(check.live.Val(), now) || (chosen != "" && UserStatus(chosen) != StatusOnline) {
+			t.forget(check.userId)
+			continue
+		}
+
+		idle := latest > 0 && latest < cutoff
+		t.mu.Lock()
+		if idle {
+			t.idle[check.userId] = true
+		} else {
+			delete(t.idle, check.userId)
+		}
+		t.mu.Unlock()
+
+		clients := clientStatusSignature(clientStatuses(check.devices.Val(), StatusOnline, now))
+		if idle == (storedIdle == "1") && clients == storedClients {
+			continue
+		}
+		flag := "0"
+		if idle {
+			flag = "1"
+		}
+		if err := redisClient.HSet(ctx, presencePrefix+check.userId, "idle", flag, "clientStatusSig", clients).Err(); err != nil {
+			logErr("Error saving idle status", err)
+			continue
+		}
+		go broadcastPresenceChange(check.userId)
+	}
+}
+
+func startIdleDetection() {
+	ticker := time.NewTicker(idleCheckInterval)
+	go func() {
+		for now := range ticker.C {
+			activity.checkIdle(now)
+		}
+	}()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActivityAt(t *testing.T) {
+	now := time.Now()
+	last := now.Add(-time.Hour).UnixMilli()
+
+	tests := []struct {
+		name         string
+		capabilities []string
+		want         int64
+	}{
+		{"no identify", nil, now.UnixMilli()},
+		{"other capabilities", []string{"compression"}, now.UnixMilli()},
+		{"reports activity", []string{"compression", capabilityActivity}, last},
+	}
+	for _, tt := range tests {
+		ws := &WSConnection{Client: ClientProperties{Capabilities: tt.capabilities}}
+		ws.lastActivity.Store(last)
+		if got := ws.activityAt(now); got != tt.want {
+			t.Errorf("%s: activityAt = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
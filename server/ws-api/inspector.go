@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// The event inspector streams this node's gateway traffic to admins over
+// /admin/inspect: client events as they arrive and every fan-out delivery.
+// Query parameters narrow it down:
+//
+//	userId     comma separated users the event comes from or goes to
+//	guildId    comma separated guilds named in the payload
+//	eventType  comma separated event types
+//	direction  inbound or outbound
+//	redact     replace payload strings other than ids and types
+//
+// Each watcher has its own bounded queue; when an admin falls behind, frames
+// are dropped and counted instead of slowing delivery down. With nobody
+// watching, the taps cost one atomic load.
+
+const (
+	inspectDirectionInbound  = "inbound"
+	inspectDirectionOutbound = "outbound"
+
+	inspectorQueueSize = 256
+)
+
+type InspectedEvent struct {
+	NodeId    string          `json:"nodeId"`
+	At        int64           `json:"at"`
+	Direction string          `json:"direction"`
+	EventType string          `json:"eventType"`
+	UserIds   []string        `json:"userIds"`
+	GuildId   string          `json:"guildId,omitempty"`
+	ChannelId string          `json:"channelId,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Dropped   uint64          `json:"dropped,omitempty"`
+}
+
+type inspectorFilter struct {
+	users      map[string]struct{}
+	guilds     map[string]struct{}
+	eventTypes map[string]struct{}
+	direction  string
+	redact     bool
+}
+
+type inspectorWatcher struct {
+	filter  inspectorFilter
+	events  chan InspectedEvent
+	dropped atomic.Uint64
+}
+
+type eventInspector struct {
+	mu       sync.RWMutex
+	watchers map[*inspectorWatcher]struct{}
+	count    atomic.Int32
+}
+
+var inspector = &eventInspector{watchers: make(map[*inspectorWatcher]struct{})}
+
+func splitFilter(value string) map[string]struct{} {
+	if value == "" {
+		return nil
+	}
+	set := make(map[string]struct{})
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			set[part] = struct{}{}
+		}
+	}
+	return set
+}
+
+func (f inspectorFilter) matches(event InspectedEvent) bool {
+	if f.direction != "" && f.direction != event.Direction {
+		return false
+	}
+	if f.eventTypes != nil {
+		if _, ok := f.eventTypes[event.EventType]; !ok {
+			return false
+		}
+	}
+	if f.guilds != nil {
+		if _, ok := f.guilds[event.GuildId]; !ok {
+			return false
+		}
+	}
+	if f.users != nil {
+		for _, userId := range event.UserIds {
+			if _, ok := f.users[userId]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func handleAdminInspect(c *gin.Context) {
+	direction := c.Query("direction")
+	if direction != "" && direction != inspectDirectionInbound && direction != inspectDirectionOutbound {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "direction must be inbound or outbound"})
+		return
+	}
+	redact, _ := strconv.ParseBool(c.Query("redact"))
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+
+	watcher := &inspectorWatcher{
+		filter: inspectorFilter{
+			users:      splitFilter(c.Query("userId")),
+			guilds:     splitFilter(c.Query("guildId")),
+			eventTypes: splitFilter(c.Query("eventType")),
+			direction:  direction,
+			redact:     redact,
+		},
+		events: make(chan InspectedEvent, inspectorQueueSize),
+	}
+	inspector.add(watcher)
+	defer inspector.remove(watcher)
+
+	// The reader only notices the admin going away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	defer conn.Close()
+	for {
+		select {
+		case <-closed:
+			return
+		case event := <-watcher.events:
+			event.Dropped = watcher.dropped.Swap(0)
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (i *eventInspector) add(w *inspectorWatcher) {
+	i.mu.Lock()
+	i.watchers[w] = struct{}{}
+	i.count.Store(int32(len(i.watchers)))
+	i.mu.Unlock()
+}
+
+func (i *eventInspector) remove(w *inspectorWatcher) {
+	i.mu.Lock()
+	delete(i.watchers, w)
+	i.count.Store(int32(len(i.watchers)))
+	i.mu.Unlock()
+}
+
+// observe hands an event to every watcher whose filter it passes. userIds are
+// the sender for inbound events and the recipients for outbound ones.
+func (i *eventInspector) observe(direction, eventType string, payload interface{}, userIds []string) {
+	if i.count.Load() == 0 {
+		return
+	}
+
+	raw, ok := payload.(json.RawMessage)
+	if !ok {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return
+		}
+		raw = b
+	}
+	var location struct {
+		GuildId   string `json:"guildId"`
+		ChannelId string `json:"channelId"`
+	}
+	_ = json.Unmarshal(raw, &location)
+
+	event := InspectedEvent{
+		NodeId:    cfg.NodeID,
+		At:        time.Now().UnixMilli(),
+		Direction: direction,
+		EventType: eventType,
+		UserIds:   userIds,
+		GuildId:   location.GuildId,
+		ChannelId: location.ChannelId,
+	}
+
+	var redacted json.RawMessage
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for w := range i.watchers {
+		if !w.filter.matches(event) {
+			continue
+		}
+		copied := event
+		if w.filter.redact {
+			if redacted == nil {
+				redacted = redactPayload(raw)
+			}
+			copied.Payload = redacted
+		} else {
+			copied.Payload = raw
+		}
+		select {
+		case w.events <- copied:
+		default:
+			w.dropped.Add(1)
+		}
+	}
+}
+
+// redactPayload keeps the shape of a payload and its ids, types and statuses
+// but hides every other string.
+func redactPayload(raw json.RawMessage) json.RawMessage {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return json.RawMessage(`"[redacted]"`)
+	}
+	return mustJSON(redactValue("", value))
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, nested := range v {
+			v[k] = redactValue(k, nested)
+		}
+		return v
+	case []interface{}:
+		for i, nested := range v {
+			v[i] = redactValue(key, nested)
+		}
+		return v
+	case string:
+		if keepsValue(key) {
+			return v
+		}
+		return fmt.Sprintf("[redacted %d chars]", len(v))
+	default:
+		return v
+	}
+}
+
+func keepsValue(key string) bool {
+	lower := strings.ToLower(key)
+	switch lower {
+	case "type", "status", "eventtype", "event_type", "platform", "level":
+		return true
+	}
+	return strings.HasSuffix(lower, "id") || strings.HasSuffix(lower, "ids")
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis/v8"
 	"github.com/liventcord/liventcord/server/telemetry"
 )
 
 func main() {
 	loadConfig()
+	loadGatewayConfig()
 	port := getEnv("Port", "8080")
 	hostname := getEnv("Host", "0.0.0.0")
 	appMode := getEnv("AppMode", "debug")
@@ -23,17 +27,21 @@ func main() {
 	} else {
 		gin.SetMode(gin.ReleaseMode)
 	}
-	r.GET("/ws", handleWebSocket)
+	r.GET("/ws", rejectWhileDraining(), handleWebSocket)
+	r.POST("/ws-ticket", handleIssueTicket)
+	r.OPTIONS("/ws-ticket", handleIssueTicket)
 	r.GET("/", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"status": "Service is running",
 		})
 	})
-	r.GET("/video-ws", func(c *gin.Context) {
+	r.GET("/video-ws", rejectWhileDraining(), func(c *gin.Context) {
 		HandleWS(c.Writer, c.Request)
 	})
 
 	startPingRoutine()
+	startRateLimitSweeper()
+	startAuthenticator()
 
 	telemetry.Init()
 
@@ -43,25 +51,43 @@ func main() {
 		r.GET("/health",
 			AdminAuthMiddleware(adminPassword),
 			telemetry.HealthHandler("WS Api", nil, nil, func() int {
-				return len(hub.status)
+				hub.lock.RLock()
+				defer hub.lock.RUnlock()
+				return len(hub.clients)
 			}),
 		)
+		registerAdminRoutes(r, adminPassword)
 	}
 
-	options, err := parseRedisURL(redisURI)
-	if err != nil {
-		log.Fatalf("Error parsing Redis URL: %v", err)
-	}
-	redisClient = redis.NewClient(options)
-
-	if redisClient != nil {
-		go consumeMessagesFromRedis()
-	}
 	if err := initRedisClient(redisURI); err != nil {
 		log.Fatalf("Failed to initialize Redis client: %v", err)
 	}
+	if err := memberships.load(); err != nil {
+		logErr("Error loading guild memberships", err)
+	}
+	startMembershipReconcile()
+	if err := startCluster(); err != nil {
+		log.Fatalf("Failed to join the cluster: %v", err)
+	}
+	startPresenceRefresh()
+	startIdleDetection()
+	startPresenceExpiry()
+	startPushNotifications()
+	startTokenRevalidation()
+	go consumeMessagesFromRedis()
+
+	srv := &http.Server{Addr: hostname + ":" + port, Handler: r}
+	go func() {
+		log.Printf("Listening on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
 
-	r.Run(hostname + ":" + port)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+	shutdownGateway(srv)
 }
 
 func AdminAuthMiddleware(adminPassword string) gin.HandlerFunc {
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The membership index maps users to the guilds they belong to and guilds to
+// their members, so presence and typing fan-out no longer has to scan every
+// guild_memberships:* key. It is loaded at startup, kept current from the
+// member and guild events flowing through event_stream and mirrored into
+// per-user Redis sets for lookups that miss the in-memory copy.
+//
+// Not every change arrives as an event: new guilds, the API rewriting the
+// keys when it starts, and an API that comes up after this process all only
+// show up in guild_memberships:*, so the index is also rebuilt from those keys
+// every MembershipReconcile. The keys expire a day after they were last
+// written, so a guild whose key is gone is kept as it was; only DELETE_GUILD
+// removes a guild.
+//
+// In cluster mode each event_stream entry is consumed by one node only, so
+// the node that applies a guild member event relays it to the others, which
+// apply it to their own index.
+//
+// DM participants are tracked the same way in dm_peers:{userId}. The .NET API
+// only delivers DMs between friends, so pairs are learned from DM and friend
+// events and dropped again on REMOVE_FRIEND. Friendships made before this
+// index existed, or while no ws-api was consuming, produce no event, so the
+// first check for a user with no dm_peers_synced:{userId} marker rebuilds the
+// set from the user's friend list, fetched from the API with the user's own
+// session token. The marker expires after a day to pick up missed events.
+
+const (
+	guildMembershipsPrefix = "guild_memberships:"
+	userGuildsPrefix       = "user_guilds:"
+	dmPeersPrefix          = "dm_peers:"
+	dmPeersSyncedPrefix    = "dm_peers_synced:"
+
+	dmPeersSyncTTL = 24 * time.Hour
+)
+
+type membershipIndex struct {
+	mu           sync.RWMutex
+	userGuilds   map[string]map[string]struct{}
+	guildMembers map[string]map[string]struct{}
+}
+
+var memberships = &membershipIndex{
+	userGuilds:   make(map[string]map[string]struct{}),
+	guildMembers: make(map[string]map[string]struct{}),
+}
+
+type memberEventPayload struct {
+	GuildID string `json:"guildId"`
+	UserID  string `json:"userId"`
+}
+
+type friendEntry struct {
+	UserID    string `json:"userId"`
+	IsPending bool   `json:"isPending"`
+}
+
+type dmEventPayload struct {
+	ChannelID string `json:"channelId"`
+	FriendID  string `json:"friendId"`
+}
+
+func (m *membershipIndex) load() error {
+	guilds, err := m.reconcile()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Loaded guild memberships for %d guilds\n", guilds)
+	return nil
+}
+
+// reconcile replaces the members of every guild that has a
+// guild_memberships key with the key's contents and returns how many guilds
+// it read.
+func (m *membershipIndex) reconcile() (int, error) {
+	iter := redisClient.Scan(ctx, 0, guildMembershipsPrefix+"*", 100).Iterator()
+	guilds := 0
+
+	for iter.Next(ctx) {
+		guildKey := iter.Val()
+		members, err := readGuildMembers(guildKey)
+		if err != nil {
+			continue
+		}
+		guildID := strings.TrimPrefix(guildKey, guildMembershipsPrefix)
+		m.setGuild(guildID, members)
+		guilds++
+	}
+
+	return guilds, iter.Err()
+}
+
+func startMembershipReconcile() {
+	if cfg.MembershipReconcile <= 0 {
+		return
+	}
+	ticker := time.NewTicker(cfg.MembershipReconcile)
+	go func() {
+		for range ticker.C {
+			if _, err := memberships.reconcile(); err != nil {
+				logErr("Error reconciling guild memberships", err)
+			}
+		}
+	}()
+}
+
+func readGuildMembers(guildKey string) ([]string, error) {
+	rawValue, err := redisClient.Get(ctx, guildKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var guildMembers []string
+	if err := json.Unmarshal([]byte(rawValue), &guildMembers); err != nil {
+		return nil, err
+	}
+	return guildMembers, nil
+}
+
+// setGuild replaces the member list of a guild, updating both directions of
+// the index and the per-user Redis sets.
+func (m *membershipIndex) setGuild(guildID string, members []string) {
+	m.mu.Lock()
+	previous := m.guildMembers[guildID]
+	current := make(map[string]struct{}, len(members))
+	for _, userID := range members {
+		current[userID] = struct{}{}
+		m.addLocked(guildID, userID)
+	}
+	var removed []string
+	for userID := range previous {
+		if _, ok := current[userID]; !ok {
+			m.removeLocked(guildID, userID)
+			removed = append(removed, userID)
+		}
+	}
+	m.mu.Unlock()
+
+	pipe := redisClient.Pipeline()
+	for _, userID := range members {
+		pipe.SAdd(ctx, userGuildsPrefix+userID, guildID)
+	}
+	for _, userID := range removed {
+		pipe.SRem(ctx, userGuildsPrefix+userID, guildID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error syncing user guild sets", err)
+	}
+}
+
+func (m *membershipIndex) add(guildID string, userIDs ...string) {
+	m.mu.Lock()
+	for _, userID := range userIDs {
+		m.addLocked(guildID, userID)
+	}
+	m.mu.Unlock()
+
+	pipe := redisClient.Pipeline()
+	for _, userID := range userIDs {
+		pipe.SAdd(ctx, userGuildsPrefix+userID, guildID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error adding guild membership", err)
+	}
+}
+
+func (m *membershipIndex) remove(guildID, userID string) {
+	m.mu.Lock()
+	m.removeLocked(guildID, userID)
+	m.mu.Unlock()
+
+	if err := redisClient.SRem(ctx, userGuildsPrefix+userID, guildID).Err(); err != nil {
+		logErr("Error removing guild membership", err)
+	}
+}
+
+// dropGuild forgets a deleted guild.
+func (m *membershipIndex) dropGuild(guildID string) {
+	m.mu.Lock()
+	members := make([]string, 0, len(m.guildMembers[guildID]))
+	for userID := range m.guildMembers[guildID] {
+		members = append(members, userID)
+	}
+	for _, userID := range members {
+		m.removeLocked(guildID, userID)
+	}
+	m.mu.Unlock()
+
+	pipe := redisClient.Pipeline()
+	for _, userID := range members {
+		pipe.SRem(ctx, userGuildsPrefix+userID, guildID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error removing deleted guild", err)
+	}
+}
+
+func (m *membershipIndex) addLocked(guildID, userID string) {
+	if userID == "" {
+		return
+	}
+	if m.guildMembers[guildID] == nil {
+		m.guildMembers[guildID] = make(map[string]struct{})
+	}
+	m.guildMembers[guildID][userID] = struct{}{}
+	if m.userGuilds[userID] == nil {
+		m.userGuilds[userID] = make(map[string]struct{})
+	}
+	m.userGuilds[userID][guildID] = struct{}{}
+}
+
+func (m *membershipIndex) removeLocked(guildID, userID string) {
+	if members, ok := m.guildMembers[guildID]; ok {
+		delete(members, userID)
+		if len(members) == 0 {
+			delete(m.guildMembers, guildID)
+		}
+	}
+	if guilds, ok := m.userGuilds[userID]; ok {
+		delete(guilds, guildID)
+		if len(guilds) == 0 {
+			delete(m.userGuilds, userID)
+		}
+	}
+}
+
+// guildsOf returns the guild IDs the user belongs to, falling back to the
+// user's Redis set when the in-memory index has no entry.
+func (m *membershipIndex) guildsOf(userID string) ([]string, error) {
+	m.mu.RLock()
+	guilds, ok := m.userGuilds[userID]
+	result := make([]string, 0, len(guilds))
+	for guildID := range guilds {
+		result = append(result, guildID)
+	}
+	m.mu.RUnlock()
+
+	if ok {
+		return result, nil
+	}
+
+	guildIDs, err := redisClient.SMembers(ctx, userGuildsPrefix+userID).Result()
+	if err != nil {
+		return nil, err
+	}
+	return guildIDs, nil
+}
+
+// membersOf returns the members of a guild, loading the guild's membership
+// key into the index if it has not been seen yet.
+func (m *membershipIndex) membersOf(guildID string) []string {
+	m.mu.RLock()
+	members, ok := m.guildMembers[guildID]
+	result := make([]string, 0, len(members))
+	for userID := range members {
+		result = append(result, userID)
+	}
+	m.mu.RUnlock()
+
+	if ok {
+		return result
+	}
+
+	loaded, err := readGuildMembers(guildMembershipsPrefix + guildID)
+	if err != nil {
+		return nil
+	}
+	m.setGuild(guildID, loaded)
+	return loaded
+}
+
+func (m *membershipIndex) isMember(guildID, userID string) bool {
+	if guildID == "" || userID == "" {
+		return false
+	}
+	for _, memberID := range m.membersOf(guildID) {
+		if memberID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *membershipIndex) areDmPeers(userID, peerID string) bool {
+	if userID == "" || peerID == "" || userID == peerID {
+		return false
+	}
+	pipe := redisClient.Pipeline()
+	isPeer := pipe.SIsMember(ctx, dmPeersPrefix+userID, peerID)
+	synced := pipe.Exists(ctx, dmPeersSyncedPrefix+userID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false
+	}
+	if isPeer.Val() || synced.Val() > 0 {
+		return isPeer.Val()
+	}
+
+	if err := m.syncDmPeers(userID, localToken(userID)); err != nil {
+		logErr("Error loading dm peers of "+userID, err)
+		return false
+	}
+	ok, err := redisClient.SIsMember(ctx, dmPeersPrefix+userID, peerID).Result()
+	return err == nil && ok
+}
+
+// syncDmPeers replaces the user's dm_peers set with their accepted friends.
+func (m *membershipIndex) syncDmPeers(userID, token string) error {
+	friends, err := fetchFriends(token)
+	if err != nil {
+		return err
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.Del(ctx, dmPeersPrefix+userID)
+	for _, friend := range friends {
+		if friend.IsPending || friend.UserID == "" || friend.UserID == userID {
+			continue
+		}
+		pipe.SAdd(ctx, dmPeersPrefix+userID, friend.UserID)
+		pipe.SAdd(ctx, dmPeersPrefix+friend.UserID, userID)
+	}
+	pipe.Set(ctx, dmPeersSyncedPrefix+userID, 1, dmPeersSyncTTL)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// fetchFriends lists the friends and pending requests of the token's user.
+func fetchFriends(token string) ([]friendEntry, error) {
+	var friends []friendEntry
+	if err := fetchAsUser(token, "/api/v1/friends", &friends); err != nil {
+		return nil, err
+	}
+	return friends, nil
+}
+
+// fetchAsUser GETs an API path with the user's session token and decodes the
+// JSON answer into out.
+func fetchAsUser(token, path string, out interface{}) error {
+	if token == "" || authenticator == nil {
+		return errors.New("no session to query the API with")
+	}
+	req, err := http.NewRequest("GET", authenticator.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := authenticator.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// localToken returns the session token of one of the user's connections on
+// this node.
+func localToken(userID string) string {
+	hub.lock.RLock()
+	defer hub.lock.RUnlock()
+	for _, ws := range hub.clients[userID] {
+		if ws.token != "" {
+			return ws.token
+		}
+	}
+	return ""
+}
+
+func (m *membershipIndex) setDmPeers(userID, peerID string, peers bool) {
+	if userID == "" || peerID == "" || userID == peerID {
+		return
+	}
+	pipe := redisClient.Pipeline()
+	if peers {
+		pipe.SAdd(ctx, dmPeersPrefix+userID, peerID)
+		pipe.SAdd(ctx, dmPeersPrefix+peerID, userID)
+	} else {
+		pipe.SRem(ctx, dmPeersPrefix+userID, peerID)
+		pipe.SRem(ctx, dmPeersPrefix+peerID, userID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error updating dm peers", err)
+	}
+}
+
+// applyEvent keeps the index current from the member and guild events the
+// .NET API publishes. Recipients of GUILD_MEMBER_ADDED are the guild's
+// existing members, so they are indexed as well in case the guild is new to
+// us. LEAVE_GUILD names the leaving user in userId; without it the event is
+// the leaving user's own confirmation and its recipients are the ones who
+// left.
+func (m *membershipIndex) applyEvent(event EventMessage, userIDs []string) {
+	switch event.EventType {
+	case "SEND_MESSAGE_DM", "EDIT_MESSAGE_DM", "ACCEPT_FRIEND", "REMOVE_FRIEND":
+		m.applyDmEvent(event, userIDs)
+		return
+	}
+	if !isGuildMemberEvent(event.EventType) {
+		return
+	}
+
+	var payload memberEventPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil || payload.GuildID == "" {
+		return
+	}
+
+	switch event.EventType {
+	case "DELETE_GUILD":
+		m.dropGuild(payload.GuildID)
+	case "LEAVE_GUILD":
+		leaving := userIDs
+		if payload.UserID != "" {
+			leaving = []string{payload.UserID}
+		}
+		for _, userID := range leaving {
+			m.remove(payload.GuildID, userID)
+		}
+	case "GUILD_MEMBER_ADDED":
+		if payload.UserID != "" {
+			m.add(payload.GuildID, append([]string{payload.UserID}, userIDs...)...)
+		}
+	case "GUILD_MEMBER_REMOVED", "KICK_MEMBER":
+		if payload.UserID != "" {
+			m.remove(payload.GuildID, payload.UserID)
+		}
+	}
+}
+
+func isGuildMemberEvent(eventType string) bool {
+	switch eventType {
+	case "GUILD_MEMBER_ADDED", "GUILD_MEMBER_REMOVED", "KICK_MEMBER", "LEAVE_GUILD", "DELETE_GUILD":
+		return true
+	}
+	return false
+}
+
+// relayMemberEvent hands a guild member event to every other node so their
+// indexes follow the one that consumed it. DM peers live in Redis only and
+// need no relay.
+func (c *clusterNode) relayMemberEvent(event EventMessage, userIDs []string) {
+	if !c.enabled || !isGuildMemberEvent(event.EventType) {
+		return
+	}
+	nodes, err := redisClient.SMembers(ctx, clusterNodesKey).Result()
+	if err != nil {
+		logErr("Error looking up nodes for member event", err)
+		return
+	}
+	for _, nodeID := range nodes {
+		if nodeID != c.nodeID {
+			c.publish(nodeID, clusterMessage{
+				Kind:      clusterKindMembership,
+				UserIDs:   userIDs,
+				EventType: event.EventType,
+				Payload:   event.Payload,
+			})
+		}
+	}
+}
+
+// applyDmEvent records the sender and recipient of DM and friend events as DM
+// peers. DM payloads carry the sender as channelId, friend payloads as
+// friendId.
+func (m *membershipIndex) applyDmEvent(event EventMessage, userIDs []string) {
+	var payload dmEventPayload
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return
+	}
+	senderID := payload.ChannelID
+	if senderID == "" {
+		senderID = payload.FriendID
+	}
+
+	peers := event.EventType != "REMOVE_FRIEND"
+	for _, recipientID := range userIDs {
+		m.setDmPeers(senderID, recipientID, peers)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newTestMembershipIndex() *membershipIndex {
+	return &membershipIndex{
+		userGuilds:   make(map[string]map[string]struct{}),
+		guildMembers: make(map[string]map[string]struct{}),
+	}
+}
+
+func sortedMembers(m *membershipIndex, guildID string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := []string{}
+	for userID := range m.guildMembers[guildID] {
+		members = append(members, userID)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func memberEvent(eventType, guildID, userID string) EventMessage {
+	payload, _ := json.Marshal(memberEventPayload{GuildID: guildID, UserID: userID})
+	return EventMessage{EventType: eventType, Payload: payload}
+}
+
+func TestMembershipApplyEvent(t *testing.T) {
+	startFakeRedis(t)
+	m := newTestMembershipIndex()
+	m.setGuild("g1", []string{"a", "b", "c"})
+
+	m.applyEvent(memberEvent("GUILD_MEMBER_ADDED", "g1", "d"), []string{"a"})
+	if got := sortedMembers(m, "g1"); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("after add: %v", got)
+	}
+
+	m.applyEvent(memberEvent("LEAVE_GUILD", "g1", "b"), []string{"a", "c", "d"})
+	if got := sortedMembers(m, "g1"); !reflect.DeepEqual(got, []string{"a", "c", "d"}) {
+		t.Fatalf("after leave with userId: %v", got)
+	}
+
+	m.applyEvent(memberEvent("LEAVE_GUILD", "g1", ""), []string{"c"})
+	if got := sortedMembers(m, "g1"); !reflect.DeepEqual(got, []string{"a", "d"}) {
+		t.Fatalf("after leave without userId: %v", got)
+	}
+
+	m.applyEvent(memberEvent("DELETE_GUILD", "g1", ""), []string{"a", "d"})
+	if got := sortedMembers(m, "g1"); len(got) != 0 {
+		t.Fatalf("deleted guild still has members: %v", got)
+	}
+	if guilds, _ := m.guildsOf("a"); len(guilds) != 0 {
+		t.Fatalf("member of deleted guild still indexed in %v", guilds)
+	}
+	if n := redisClient.SCard(ctx, userGuildsPrefix+"a").Val(); n != 0 {
+		t.Fatalf("user_guilds set still holds %d guilds", n)
+	}
+}
+
+func TestMembershipReconcile(t *testing.T) {
+	startFakeRedis(t)
+	m := newTestMembershipIndex()
+	m.setGuild("g1", []string{"a", "b"})
+	m.setGuild("g2", []string{"a"})
+
+	redisClient.Set(ctx, guildMembershipsPrefix+"g1", `["a","c"]`, 0)
+	redisClient.Set(ctx, guildMembershipsPrefix+"g3", `["b"]`, 0)
+
+	guilds, err := m.reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if guilds != 2 {
+		t.Fatalf("reconciled %d guilds, want 2", guilds)
+	}
+	if got := sortedMembers(m, "g1"); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Fatalf("rewritten guild: %v", got)
+	}
+	if got := sortedMembers(m, "g2"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("guild without a key should be kept: %v", got)
+	}
+	if got := sortedMembers(m, "g3"); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("new guild: %v", got)
+	}
+}
+
+func TestAreDmPeersBackfillsFromFriendList(t *testing.T) {
+	startFakeRedis(t)
+
+	var requests []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("Authorization"))
+		w.Write([]byte(`[{"userId":"friend"},{"userId":"pending","isPending":true}]`))
+	}))
+	defer api.Close()
+
+	previousAuth := authenticator
+	authenticator = newSessionAuthenticator(api.URL)
+	hub.lock.Lock()
+	hub.clients["user"] = []*WSConnection{{token: "session-token"}}
+	hub.lock.Unlock()
+	t.Cleanup(func() {
+		authenticator = previousAuth
+		hub.lock.Lock()
+		delete(hub.clients, "user")
+		hub.lock.Unlock()
+	})
+
+	m := newTestMembershipIndex()
+	if !m.areDmPeers("user", "friend") {
+		t.Fatal("accepted friend should be a dm peer")
+	}
+	if m.areDmPeers("user", "pending") {
+		t.Fatal("pending friend should not be a dm peer")
+	}
+	if m.areDmPeers("user", "stranger") {
+		t.Fatal("stranger should not be a dm peer")
+	}
+	if len(requests) != 1 || requests[0] != "GET /api/v1/friends Bearer session-token" {
+		t.Fatalf("friend list requests = %q, want one authenticated GET", requests)
+	}
+	if ok, _ := redisClient.SIsMember(ctx, dmPeersPrefix+"friend", "user").Result(); !ok {
+		t.Fatal("backfill should record the pair in both directions")
+	}
+}
+
+func TestMemberEventsReachEveryNode(t *testing.T) {
+	f := startFakeRedis(t)
+	previousCluster, previousIndex := *cluster, memberships
+	t.Cleanup(func() {
+		*cluster = previousCluster
+		memberships = previousIndex
+	})
+	cluster.enabled = true
+	cluster.nodeID = "node-a"
+	redisClient.SAdd(ctx, clusterNodesKey, "node-a", "node-b")
+
+	cluster.relayMemberEvent(memberEvent("KICK_MEMBER", "g1", "kicked"), []string{"stays"})
+	cluster.relayMemberEvent(EventMessage{EventType: "SEND_MESSAGE_DM", Payload: json.RawMessage(`{}`)}, []string{"x"})
+
+	if got := f.messages(clusterChannelPrefix + "node-a"); len(got) != 0 {
+		t.Fatalf("relayed to itself: %v", got)
+	}
+	relayed := f.messages(clusterChannelPrefix + "node-b")
+	if len(relayed) != 1 {
+		t.Fatalf("node-b got %d messages, want only the member event", len(relayed))
+	}
+
+	// node-b still has the kicked user until it applies the relayed event.
+	memberships = newTestMembershipIndex()
+	memberships.setGuild("g1", []string{"kicked", "stays"})
+	cluster.handle(relayed[0])
+	if got := sortedMembers(memberships, "g1"); !reflect.DeepEqual(got, []string{"stays"}) {
+		t.Fatalf("members after relay = %v, want [stays]", got)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Unread mention counters are kept by the gateway from the messages flowing
+// through event_stream. A guild message counts for every recipient it
+// mentions with <@userId> or @everyone; every DM counts for its recipient.
+// Guilds have no roles yet, so <@&roleId> mentions nobody. Counters are
+// cleared by MESSAGE_ACK.
+//
+//	mention_counts:{userId}     hash of "{guildId}:{channelId}" -> count
+//	mention_applied:{messageId} set once a message was counted, so a stream
+//	                            entry delivered twice is not counted twice
+//
+// DM counters use an empty guildId and the sender as channelId.
+
+const (
+	mentionCountsPrefix  = "mention_counts:"
+	mentionAppliedPrefix = "mention_applied:"
+
+	mentionAppliedTTL = 24 * time.Hour
+)
+
+var (
+	userMentionPattern = regexp.MustCompile(`<@(\d+)>`)
+	everyonePattern    = regexp.MustCompile(`(^|\s)@everyone\b`)
+)
+
+type MentionCount struct {
+	GuildId   string `json:"guildId,omitempty"`
+	ChannelId string `json:"channelId"`
+	Count     int64  `json:"count"`
+}
+
+type MentionCountsSnapshot struct {
+	Counts []MentionCount `json:"counts"`
+}
+
+type mentionedMessage struct {
+	MessageId string `json:"messageId"`
+	UserId    string `json:"userId"`
+	ChannelId string `json:"channelId"`
+	Content   string `json:"content"`
+}
+
+func mentionField(guildId, channelId string) string {
+	return guildId + ":" + channelId
+}
+
+// applyMentionEvent bumps the counters of everyone a new message mentions,
+// pushes MENTION_COUNT_UPDATE to them and notifies those who are away.
+func applyMentionEvent(event EventMessage, userIDs []string) {
+	switch event.EventType {
+	case "SEND_MESSAGE_GUILD":
+		var payload struct {
+			GuildId   string             `json:"guildId"`
+			ChannelId string             `json:"channelId"`
+			Messages  []mentionedMessage `json:"messages"`
+		}
+		if err := json.Unmarshal(event.Payload, &payload); err != nil || payload.GuildId == "" {
+			return
+		}
+		for _, message := range payload.Messages {
+			if !firstMentionApply(message.MessageId) {
+				continue
+			}
+			mentioned := guildMentions(message, userIDs)
+			counts := incrementMentions(payload.GuildId, payload.ChannelId, mentioned)
+			notifyAway(payload.GuildId, payload.ChannelId, message, counts)
+		}
+
+	case "SEND_MESSAGE_DM":
+		var payload struct {
+			ChannelId string           `json:"channelId"`
+			Message   mentionedMessage `json:"message"`
+		}
+		if err := json.Unmarshal(event.Payload, &payload); err != nil || payload.ChannelId == "" {
+			return
+		}
+		if !firstMentionApply(payload.Message.MessageId) {
+			return
+		}
+		var recipients []string
+		for _, userId := range userIDs {
+			if userId != payload.ChannelId {
+				recipients = append(recipients, userId)
+			}
+		}
+		counts := incrementMentions("", payload.ChannelId, recipients)
+		notifyAway("", payload.ChannelId, payload.Message, counts)
+	}
+}
+
+// firstMentionApply claims the message for counting and reports whether this
+// is the first time it is seen. Messages without an id are always counted.
+func firstMentionApply(messageId string) bool {
+	if messageId == "" {
+		return true
+	}
+	first, err := redisClient.SetNX(ctx, mentionAppliedPrefix+messageId, 1, mentionAppliedTTL).Result()
+	if err != nil {
+		logErr("Error claiming message for mention counts", err)
+		return true
+	}
+	return first
+}
+
+// guildMentions returns the recipients a guild message mentions, never the
+// author.
+func guildMentions(message mentionedMessage, recipients []string) []string {
+	if message.Content == "" {
+		return nil
+	}
+
+	candidates := make(map[string]struct{})
+	if everyonePattern.MatchString(message.Content) {
+		for _, userId := range recipients {
+			candidates[userId] = struct{}{}
+		}
+	} else {
+		for _, match := range userMentionPattern.FindAllStringSubmatch(message.Content, -1) {
+			candidates[match[1]] = struct{}{}
+		}
+	}
+
+	var mentioned []string
+	for _, userId := range recipients {
+		if userId == message.UserId {
+			continue
+		}
+		if _, ok := candidates[userId]; ok {
+			mentioned = append(mentioned, userId)
+		}
+	}
+	return mentioned
+}
+
+// incrementMentions returns the new count of each user.
+func incrementMentions(guildId, channelId string, userIds []string) map[string]int64 {
+	if len(userIds) == 0 || channelId == "" {
+		return nil
+	}
+
+	field := mentionField(guildId, channelId)
+	pipe := redisClient.Pipeline()
+	counts := make([]*redis.IntCmd, len(userIds))
+	for i, userId := range userIds {
+		counts[i] = pipe.HIncrBy(ctx, mentionCountsPrefix+userId, field, 1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error updating mention counts", err)
+		return nil
+	}
+
+	result := make(map[string]int64, len(userIds))
+	for i, userId := range userIds {
+		result[userId] = counts[i].Val()
+		deliverToUsers("MENTION_COUNT_UPDATE", MentionCount{
+			GuildId:   guildId,
+			ChannelId: channelId,
+			Count:     counts[i].Val(),
+		}, []string{userId})
+	}
+	return result
+}
+
+// clearMentions resets a channel's counter after the user read it.
+func clearMentions(userId, guildId, channelId string) {
+	removed, err := redisClient.HDel(ctx, mentionCountsPrefix+userId, mentionField(guildId, channelId)).Result()
+	if err != nil {
+		logErr("Error clearing mention count", err)
+		return
+	}
+	if removed == 0 {
+		return
+	}
+	deliverToUsers("MENTION_COUNT_UPDATE", MentionCount{GuildId: guildId, ChannelId: channelId}, []string{userId})
+}
+
+func mentionCounts(userId string) MentionCountsSnapshot {
+	snapshot := MentionCountsSnapshot{Counts: []MentionCount{}}
+	fields, err := redisClient.HGetAll(ctx, mentionCountsPrefix+userId).Result()
+	if err != nil {
+		logErr("Error reading mention counts", err)
+		return snapshot
+	}
+	for field, value := range fields {
+		guildId, channelId, ok := strings.Cut(field, ":")
+		count, err := strconv.ParseInt(value, 10, 64)
+		if !ok || err != nil || count <= 0 {
+			continue
+		}
+		snapshot.Counts = append(snapshot.Counts, MentionCount{
+			GuildId:   guildId,
+			ChannelId: channelId,
+			Count:     count,
+		})
+	}
+	return snapshot
+}
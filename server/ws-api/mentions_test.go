@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestGuildMentions(t *testing.T) {
+	recipients := []string{"111", "222", "333"}
+	tests := []struct {
+		name    string
+		author  string
+		content string
+		want    []string
+	}{
+		{"no mentions", "111", "hello", nil},
+		{"user mention", "111", "hi <@222>", []string{"222"}},
+		{"mention of a non recipient", "111", "hi <@999>", nil},
+		{"author mentioning themselves", "111", "<@111> <@333>", []string{"333"}},
+		{"everyone", "111", "@everyone look", []string{"222", "333"}},
+		{"everyone inside a word", "111", "mail@everyone.com", nil},
+		{"role mention", "111", "<@&444>", nil},
+	}
+	for _, tt := range tests {
+		got := guildMentions(mentionedMessage{UserId: tt.author, Content: tt.content}, recipients)
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: mentioned %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyMentionEventCountsEachMessageOnce(t *testing.T) {
+	startFakeRedis(t)
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"guildId":   "guild",
+		"channelId": "channel",
+		"messages": []mentionedMessage{
+			{MessageId: "m1", UserId: "111", ChannelId: "channel", Content: "<@222>"},
+		},
+	})
+	event := EventMessage{EventType: "SEND_MESSAGE_GUILD", Payload: payload}
+
+	applyMentionEvent(event, []string{"222"})
+	applyMentionEvent(event, []string{"222"})
+
+	count, err := redisClient.HGet(ctx, mentionCountsPrefix+"222", mentionField("guild", "channel")).Result()
+	if err != nil || count != "1" {
+		t.Fatalf("mention count = %q (%v), want 1 after a redelivered message", count, err)
+	}
+}
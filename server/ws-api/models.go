@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gorilla/websocket"
 )
@@ -10,6 +11,7 @@ import (
 type EventMessage struct {
 	EventType string          `json:"event_type"`
 	Payload   json.RawMessage `json:"payload"`
+	Nonce     json.RawMessage `json:"nonce,omitempty"`
 }
 
 type UserStatus string
@@ -22,24 +24,39 @@ const (
 )
 
 type UserStatusResponse struct {
-	UserId string     `json:"userId"`
-	Status UserStatus `json:"status"`
+	UserId       string                `json:"userId"`
+	Status       UserStatus            `json:"status"`
+	CustomStatus *CustomStatus         `json:"customStatus,omitempty"`
+	Activities   []Activity            `json:"activities,omitempty"`
+	ClientStatus map[string]UserStatus `json:"clientStatus,omitempty"`
 }
 
 type WSConnection struct {
-	Conn  *websocket.Conn
-	Mutex sync.Mutex
+	Conn    *websocket.Conn
+	Mutex   sync.Mutex
+	Session *GatewaySession
+	Send    chan []byte
+	Client  ClientProperties
+
+	token        string
+	version      int
+	compressor   *frameCompressor
+	codec        *wireCodec
+	lastSeen     atomic.Int64
+	lastActivity atomic.Int64
+	pingRtt      atomic.Int64
+	done         chan struct{}
+	closeOnce    sync.Once
+	metrics      connectionMetrics
 }
 
 type Hub struct {
 	lock    sync.RWMutex
 	clients map[string][]*WSConnection
-	status  map[string]UserStatus
 }
 
 var hub = Hub{
 	clients: make(map[string][]*WSConnection),
-	status:  make(map[string]UserStatus),
 }
 
 type VcConnection struct {
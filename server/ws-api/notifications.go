@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+// Mentions and DMs for users who are offline, or whose devices have all gone
+// idle, are sent as Web Push notifications. Browsers register their
+// subscriptions over the gateway and users mute guilds, channels or
+// everything, optionally until a given time:
+//
+//	push_subscriptions:{userId}     hash of endpoint -> PushSubscription
+//	push_settings:{userId}          NotificationSettings
+//	push_collapse:{userId}:{field}  set for PushCollapseWindow after a notification,
+//	                                field being "{guildId}:{channelId}" as in mentions.go
+//
+// While a channel's collapse key exists further messages in it do not notify
+// again; the next notification carries the channel's mention count. Users on
+// DND get no notifications. Push is off unless VapidPrivateKey is set.
+
+const (
+	pushSubscriptionsPrefix = "push_subscriptions:"
+	pushSettingsPrefix      = "push_settings:"
+	pushCollapsePrefix      = "push_collapse:"
+
+	notificationSettingsEvent = "NOTIFICATION_SETTINGS"
+
+	maxPushSubscriptions = 10
+	maxMuteRules         = 200
+	pushQueueSize        = 1024
+	pushContentLength    = 200
+)
+
+// MuteRule silences notifications from a channel, a guild, or everything when
+// both ids are empty. DM channels are muted by the other user's id with no
+// guildId. Until is unix ms; zero mutes until the rule is removed.
+type MuteRule struct {
+	GuildId   string `json:"guildId,omitempty"`
+	ChannelId string `json:"channelId,omitempty"`
+	Until     int64  `json:"until,omitempty"`
+}
+
+type NotificationSettings struct {
+	MuteRules []MuteRule `json:"muteRules"`
+}
+
+// NotificationSettingsResponse also tells clients whether push is available
+// and the key to subscribe with.
+type NotificationSettingsResponse struct {
+	NotificationSettings
+	PushEnabled    bool   `json:"pushEnabled"`
+	VapidPublicKey string `json:"vapidPublicKey,omitempty"`
+}
+
+type UnregisterPushSubscriptionPayload struct {
+	Endpoint string `json:"endpoint"`
+}
+
+// PushNotification is the decrypted payload the service worker receives. Tag
+// is the same for every notification of a channel so it can replace the one
+// already shown.
+type PushNotification struct {
+	Type      string `json:"type"`
+	GuildId   string `json:"guildId,omitempty"`
+	ChannelId string `json:"channelId"`
+	MessageId string `json:"messageId"`
+	AuthorId  string `json:"authorId"`
+	Content   string `json:"content"`
+	Count     int64  `json:"count"`
+	Tag       string `json:"tag"`
+}
+
+type pushJob struct {
+	userId       string
+	notification PushNotification
+}
+
+var (
+	pushSigner *vapidSigner
+	pushQueue  chan pushJob
+)
+
+func startPushNotifications() {
+	if cfg.VapidPrivateKey == "" {
+		fmt.Println("Web Push notifications are disabled, VapidPrivateKey is not set")
+		return
+	}
+	signer, err := newVapidSigner(cfg.VapidPrivateKey, cfg.VapidSubject)
+	if err != nil {
+		logErr("Web Push notifications are disabled", err)
+		return
+	}
+
+	pushSigner = signer
+	pushQueue = make(chan pushJob, pushQueueSize)
+	for i := 0; i < cfg.PushWorkers; i++ {
+		go runPushWorker(signer)
+	}
+	fmt.Println("Web Push notifications enabled with VAPID key", signer.publicKey)
+}
+
+func handleRegisterPushSubscription(conn *websocket.Conn, event EventMessage, userId string) {
+	if pushSigner == nil {
+		rejectEvent(conn, userId, event, errorUnsupported, errors.New("push notifications are disabled"))
+		return
+	}
+	var sub PushSubscription
+	if err := unmarshalPayload(event, &sub); err != nil {
+		rejectEvent(conn, userId, event, errorInvalidPayload, err)
+		return
+	}
+	if _, ok := validPushEndpoint(sub.Endpoint); !ok {
+		rejectEvent(conn, userId, event, errorInvalidValue, invalidField("endpoint", "endpoint is not an allowed push service URL"))
+		return
+	}
+	if _, _, err := subscriptionKeys(sub); err != nil {
+		rejectEvent(conn, userId, event, errorInvalidValue, invalidField("keys", "%v", err))
+		return
+	}
+
+	key := pushSubscriptionsPrefix + userId
+	pipe := redisClient.Pipeline()
+	count := pipe.HLen(ctx, key)
+	exists := pipe.HExists(ctx, key, sub.Endpoint)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error reading push subscriptions", err)
+		return
+	}
+	if !exists.Val() && count.Val() >= maxPushSubscriptions {
+		rejectEvent(conn, userId, event, errorLimitExceeded, fmt.Errorf("at most %d push subscriptions are allowed", maxPushSubscriptions))
+		return
+	}
+
+	if err := redisClient.HSet(ctx, key, sub.Endpoint, []byte(mustJSON(sub))).Err(); err != nil {
+		logErr("Error saving push subscription", err)
+	}
+}
+
+func handleUnregisterPushSubscription(conn *websocket.Conn, event EventMessage, userId string) {
+	var payload UnregisterPushSubscriptionPayload
+	if err := unmarshalPayload(event, &payload); err != nil || payload.Endpoint == "" {
+		return
+	}
+	if err := redisClient.HDel(ctx, pushSubscriptionsPrefix+userId, payload.Endpoint).Err(); err != nil {
+		logErr("Error removing push subscription", err)
+	}
+}
+
+// handleUpdateNotificationSettings replaces the user's mute rules. Expired
+// rules are dropped and the result is echoed to all of the user's sessions.
+func handleUpdateNotificationSettings(conn *websocket.Conn, event EventMessage, userId string) {
+	var settings NotificationSettings
+	if err := unmarshalPayload(event, &settings); err != nil {
+		rejectEvent(conn, userId, event, errorInvalidPayload, err)
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	rules := []MuteRule{}
+	for _, rule := range settings.MuteRules {
+		if rule.Until != 0 && rule.Until <= now {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) > maxMuteRules {
+		rules = rules[:maxMuteRules]
+	}
+	settings.MuteRules = rules
+
+	if err := redisClient.Set(ctx, pushSettingsPrefix+userId, []byte(mustJSON(settings)), 0).Err(); err != nil {
+		logErr("Error saving notification settings", err)
+		return
+	}
+
+	deliverToUsers(notificationSettingsEvent, notificationSettingsResponse(settings), []string{userId})
+}
+
+func decodeNotificationSettings(raw string) NotificationSettings {
+	settings := NotificationSettings{MuteRules: []MuteRule{}}
+	if raw != "" {
+		json.Unmarshal([]byte(raw), &settings)
+	}
+	return settings
+}
+
+func notificationSettings(userId string) NotificationSettings {
+	raw, err := redisClient.Get(ctx, pushSettingsPrefix+userId).Result()
+	if err != nil && err != redis.Nil {
+		logErr("Error reading notification settings", err)
+	}
+	return decodeNotificationSettings(raw)
+}
+
+func notificationSettingsResponse(settings NotificationSettings) NotificationSettingsResponse {
+	response := NotificationSettingsResponse{NotificationSettings: settings}
+	if pushSigner != nil {
+		response.PushEnabled = true
+		response.VapidPublicKey = pushSigner.publicKey
+	}
+	return response
+}
+
+// mutes reports whether a rule silences the channel at now (unix ms).
+func (s NotificationSettings) mutes(guildId, channelId string, now int64) bool {
+	for _, rule := range s.MuteRules {
+		if rule.Until != 0 && rule.Until <= now {
+			continue
+		}
+		switch {
+		case rule.GuildId == "" && rule.ChannelId == "":
+			return true
+		case rule.ChannelId == "":
+			if rule.GuildId == guildId {
+				return true
+			}
+		case rule.ChannelId == channelId && rule.GuildId == guildId:
+			return true
+		}
+	}
+	return false
+}
+
+// notifyAway queues a notification for each counted user who is away, has a
+// push subscription, has not muted the channel and was not notified about it
+// within the collapse window. counts holds each user's new mention count.
+func notifyAway(guildId, channelId string, message mentionedMessage, counts map[string]int64) {
+	if pushQueue == nil || len(counts) == 0 {
+		return
+	}
+
+	type awayState struct {
+		live          *redis.StringSliceCmd
+		state         *redis.SliceCmd
+		settings      *redis.StringCmd
+		subscriptions *redis.IntCmd
+	}
+	userIds := make([]string, 0, len(counts))
+	states := make([]awayState, 0, len(counts))
+	pipe := redisClient.Pipeline()
+	for userId := range counts {
+		userIds = append(userIds, userId)
+		states = append(states, awayState{
+			live:          pipe.HVals(ctx, presenceLivePrefix+userId),
+			state:         pipe.HMGet(ctx, presencePrefix+userId, "status", "idle"),
+			settings:      pipe.Get(ctx, pushSettingsPrefix+userId),
+			subscriptions: pipe.HLen(ctx, pushSubscriptionsPrefix+userId),
+		})
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		logErr("Error reading notification state", err)
+		return
+	}
+
+	field := mentionField(guildId, channelId)
+	now := time.Now().UnixMilli()
+	kind := "mention"
+	if guildId == "" {
+		kind = "dm"
+	}
+
+	for i, userId := range userIds {
+		state := states[i]
+		if state.subscriptions.Val() == 0 {
+			continue
+		}
+		values := state.state.Val()
+		if len(values) != 2 {
+			continue
+		}
+		status, _ := values[0].(string)
+		idle, _ := values[1].(string)
+		if UserStatus(status) == StatusDND {
+			continue
+		}
+		if isLive(state.live.Val(), time.Now()) && idle != "1" {
+			continue
+		}
+		if decodeNotificationSettings(state.settings.Val()).mutes(guildId, channelId, now) {
+			continue
+		}
+
+		first, err := redisClient.SetNX(ctx, pushCollapsePrefix+userId+":"+field, 1, cfg.PushCollapseWindow).Result()
+		if err != nil {
+			logErr("Error collapsing push notification", err)
+			continue
+		}
+		if !first {
+			continue
+		}
+
+		job := pushJob{
+			userId: userId,
+			notification: PushNotification{
+				Type:      kind,
+				GuildId:   guildId,
+				ChannelId: channelId,
+				MessageId: message.MessageId,
+				AuthorId:  message.UserId,
+				Content:   truncateRunes(message.Content, pushContentLength),
+				Count:     counts[userId],
+				Tag:       field,
+			},
+		}
+		select {
+		case pushQueue <- job:
+		default:
+			fmt.Printf("Push queue is full, dropping notification for user %s\n", userId)
+		}
+	}
+}
+
+func truncateRunes(value string, limit int) string {
+	runes := []rune(value)
+	if len(runes) <= limit {
+		return value
+	}
+	return string(runes[:limit])
+}
+
+func runPushWorker(signer *vapidSigner) {
+	for job := range pushQueue {
+		deliverPush(signer, job)
+	}
+}
+
+// deliverPush sends a notification to every subscription of the user and
+// forgets the ones the push service reports as gone.
+func deliverPush(signer *vapidSigner, job pushJob) {
+	key := pushSubscriptionsPrefix + job.userId
+	subscriptions, err := redisClient.HGetAll(ctx, key).Result()
+	if err != nil {
+		logErr("Error reading push subscriptions", err)
+		return
+	}
+
+	message := pushMessage{
+		payload: mustJSON(job.notification),
+		topic:   pushTopic(job.notification.Tag),
+		urgency: "high",
+	}
+	for endpoint, raw := range subscriptions {
+		var sub PushSubscription
+		if json.Unmarshal([]byte(raw), &sub) != nil {
+			redisClient.HDel(ctx, key, endpoint)
+			continue
+		}
+		err := sendPush(signer, sub, message)
+		if err == errPushGone {
+			logErr("Error removing push subscription", redisClient.HDel(ctx, key, endpoint).Err())
+			continue
+		}
+		logErr("Error sending push notification", err)
+	}
+}
@@ -44,15 +44,27 @@ func pingVcHubClients(h *VcHub) {
 	}
 }
 
-// Ping for hub
+// Ping for hub, closing connections that missed too many heartbeats
 func pingHubClients(h *Hub) {
+	now := time.Now()
+	var zombies []*WSConnection
+
 	h.lock.RLock()
-	defer h.lock.RUnlock()
 	for _, conns := range h.clients {
 		for _, ws := range conns {
-			if ws.Conn != nil {
-				_ = ws.Conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(pingTimeout))
+			if ws.Conn == nil {
+				continue
+			}
+			if ws.isZombie(now) {
+				zombies = append(zombies, ws)
+				continue
 			}
+			_ = ws.Conn.WriteControl(websocket.PingMessage, pingPayload(now), now.Add(pingTimeout))
 		}
 	}
+	h.lock.RUnlock()
+
+	for _, ws := range zombies {
+		closeZombie(ws)
+	}
 }
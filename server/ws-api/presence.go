@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Presence lives in Redis so it survives restarts and is shared between
+// replicas and the .NET API:
+//
+//	presence:{userId}       hash with the status the user picked, when, whether
+//	                        they went idle on top of it (see idle.go) and their
+//	                        custom status and activities (see richpresence.go)
+//	presence_live:{userId}  hash of nodeId -> last refresh, expires after PresenceTTL
+//	presence_devices:{..}   device classes per node, for clientStatus (see devices.go)
+//	presence_updates        pub/sub channel carrying every visible status change
+//
+// A user is online while presence_live holds an entry refreshed within
+// PresenceTTL. The key TTL alone is not enough: it is shared by every node's
+// field, so a node that died without cleaning up (container hostnames change
+// on every deploy) would otherwise stay live as long as any other node keeps
+// refreshing the key. The chosen status is kept without a TTL, so DND or
+// invisible sticks across reconnects.
+
+const (
+	presencePrefix         = "presence:"
+	presenceLivePrefix     = "presence_live:"
+	presenceUpdatesChannel = "presence_updates"
+)
+
+type presenceStore struct{}
+
+var presence = presenceStore{}
+
+// chosenStatus returns the status the user picked, or online if they never
+// picked one.
+func (presenceStore) chosenStatus(userId string) UserStatus {
+	status, err := redisClient.HGet(ctx, presencePrefix+userId, "status").Result()
+	if err != nil || !isValidStatus(UserStatus(status)) {
+		return StatusOnline
+	}
+	return UserStatus(status)
+}
+
+// setChosenStatus stores the status the user picked. A non-zero expiresAt
+// (unix ms) reverts it to online at that time.
+func (presenceStore) setChosenStatus(userId string, status UserStatus, expiresAt int64) error {
+	pipe := redisClient.TxPipeline()
+	pipe.HSet(ctx, presencePrefix+userId,
+		"status", string(status),
+		"updatedAt", time.Now().Unix(),
+		"statusExpiresAt", expiresAt,
+	)
+	scheduleExpiry(pipe, "status:"+userId, expiresAt)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// markLive records that this node holds a connection for each user.
+func (presenceStore) markLive(userIds ...string) {
+	if len(userIds) == 0 {
+		return
+	}
+	now := time.Now().Unix()
+	pipe := redisClient.Pipeline()
+	for _, userId := range userIds {
+		key := presenceLivePrefix + userId
+		pipe.HSet(ctx, key, cfg.NodeID, now)
+		pipe.Expire(ctx, key, cfg.PresenceTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error refreshing presence", err)
+	}
+}
+
+// clearLive removes this node's liveness entry, drops entries other nodes
+// stopped refreshing, and reports whether the user is still connected through
+// another node.
+func (presenceStore) clearLive(userId string) bool {
+	key := presenceLivePrefix + userId
+	pipe := redisClient.TxPipeline()
+	pipe.HDel(ctx, key, cfg.NodeID)
+	pipe.HDel(ctx, presenceActivePrefix+userId, cfg.NodeID)
+	pipe.HDel(ctx, presenceDevicesPrefix+userId, cfg.NodeID)
+	remaining := pipe.HGetAll(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error clearing presence", err)
+		return false
+	}
+
+	fresh, stale := splitLiveNodes(remaining.Val(), time.Now())
+	if len(stale) > 0 {
+		pipe := redisClient.TxPipeline()
+		pipe.HDel(ctx, key, stale...)
+		pipe.HDel(ctx, presenceActivePrefix+userId, stale...)
+		pipe.HDel(ctx, presenceDevicesPrefix+userId, stale...)
+		if _, err := pipe.Exec(ctx); err != nil {
+			logErr("Error clearing stale presence", err)
+		}
+	}
+	return len(fresh) > 0
+}
+
+// splitLiveNodes sorts a presence_live hash into the nodes that refreshed
+// within PresenceTTL and those that did not.
+func splitLiveNodes(entries map[string]string, now time.Time) (fresh, stale []string) {
+	cutoff := now.Add(-cfg.PresenceTTL).Unix()
+	for nodeID, value := range entries {
+		if at, err := strconv.ParseInt(value, 10, 64); err == nil && at >= cutoff {
+			fresh = append(fresh, nodeID)
+		} else {
+			stale = append(stale, nodeID)
+		}
+	}
+	return fresh, stale
+}
+
+// isLive reports whether any of the refresh times read from a presence_live
+// hash is within PresenceTTL.
+func isLive(refreshed []string, now time.Time) bool {
+	cutoff := now.Add(-cfg.PresenceTTL).Unix()
+	for _, value := range refreshed {
+		if at, err := strconv.ParseInt(value, 10, 64); err == nil && at >= cutoff {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveStatuses resolves what other users should see for each user:
+// the chosen status while they are live (idle if they went idle while
+// online), offline otherwise, and offline for invisible users. Users who are
+// not offline also carry their custom status, activities and clientStatus.
+func (presenceStore) effectiveStatuses(userIds []string) map[string]UserStatusResponse {
+	result := make(map[string]UserStatusResponse, len(userIds))
+	if len(userIds) == 0 {
+		return result
+	}
+
+	pipe := redisClient.Pipeline()
+	chosen := make([]*redis.SliceCmd, len(userIds))
+	live := make([]*redis.StringSliceCmd, len(userIds))
+	nodeDevices := make([]*redis.StringSliceCmd, len(userIds))
+	for i, userId := range userIds {
+		chosen[i] = pipe.HMGet(ctx, presencePrefix+userId, "status", "idle", "customStatus", "activities")
+		live[i] = pipe.HVals(ctx, presenceLivePrefix+userId)
+		nodeDevices[i] = pipe.HVals(ctx, presenceDevicesPrefix+userId)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		logErr("Error reading presence", err)
+	}
+
+	now := time.Now()
+	for i, userId := range userIds {
+		response := UserStatusResponse{UserId: userId, Status: StatusOffline}
+		state := chosen[i].Val()
+		if !isLive(live[i].Val(), now) || len(state) != 4 {
+			result[userId] = response
+			continue
+		}
+		chosenStatus, _ := state[0].(string)
+		idle, _ := state[1].(string)
+		status := UserStatus(chosenStatus)
+		if !isValidStatus(status) {
+			status = StatusOnline
+		}
+		response.ClientStatus = clientStatuses(nodeDevices[i].Val(), visibleStatus(status), now)
+		if status == StatusOnline && idle == "1" {
+			status = StatusIdle
+		}
+		response.Status = visibleStatus(status)
+		if response.Status != StatusOffline {
+			response.CustomStatus, response.Activities = decodePresenceDetails(state[2], state[3])
+		}
+		result[userId] = response
+	}
+	return result
+}
+
+func (presenceStore) publish(response UserStatusResponse) {
+	b, err := json.Marshal(response)
+	if err != nil {
+		return
+	}
+	if err := redisClient.Publish(ctx, presenceUpdatesChannel, b).Err(); err != nil {
+		logErr("Error publishing presence update", err)
+	}
+}
+
+func visibleStatus(status UserStatus) UserStatus {
+	if status == StatusInvisible {
+		return StatusOffline
+	}
+	return status
+}
+
+// startPresenceRefresh keeps the liveness entries of every locally connected
+// user from expiring.
+func startPresenceRefresh() {
+	ticker := time.NewTicker(cfg.PresenceRefresh)
+	go func() {
+		for range ticker.C {
+			hub.lock.RLock()
+			userIds := make([]string, 0, len(hub.clients))
+			for userId := range hub.clients {
+				userIds = append(userIds, userId)
+			}
+			hub.lock.RUnlock()
+
+			presence.markLive(userIds...)
+		}
+	}()
+}
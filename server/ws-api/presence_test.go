@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClearLiveDropsStaleNodes(t *testing.T) {
+	startFakeRedis(t)
+	previous := cfg
+	t.Cleanup(func() { cfg = previous })
+	cfg.NodeID = "node-a"
+	cfg.PresenceTTL = 90 * time.Second
+
+	now := time.Now()
+	key := presenceLivePrefix + "user-1"
+	redisClient.HSet(ctx, key,
+		"node-a", now.Unix(),
+		"node-old", now.Add(-10*time.Minute).Unix(),
+	)
+	if presence.clearLive("user-1") {
+		t.Fatal("user with only a stale node left should not be live")
+	}
+	if n := redisClient.HLen(ctx, key).Val(); n != 0 {
+		t.Fatalf("stale entries left behind: %d", n)
+	}
+
+	redisClient.HSet(ctx, key,
+		"node-a", now.Unix(),
+		"node-b", strconv.FormatInt(now.Add(-time.Second).Unix(), 10),
+	)
+	if !presence.clearLive("user-1") {
+		t.Fatal("user still connected through node-b should be live")
+	}
+}
+
+func TestIsLive(t *testing.T) {
+	previous := cfg
+	t.Cleanup(func() { cfg = previous })
+	cfg.PresenceTTL = 90 * time.Second
+
+	now := time.Now()
+	tests := []struct {
+		name      string
+		refreshed []string
+		want      bool
+	}{
+		{"none", nil, false},
+		{"fresh", []string{strconv.FormatInt(now.Unix(), 10)}, true},
+		{"stale", []string{strconv.FormatInt(now.Add(-time.Hour).Unix(), 10)}, false},
+		{"one of two fresh", []string{strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), strconv.FormatInt(now.Unix(), 10)}, true},
+		{"garbage", []string{"yesterday"}, false},
+	}
+	for _, tt := range tests {
+		if got := isLive(tt.refreshed, now); got != tt.want {
+			t.Errorf("%s: isLive = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The gateway protocol is versioned. Clients open /ws and /video-ws with
+// ?v=<version>; without it they are taken to speak version 1, the protocol
+// from before versions were negotiated. A client asking for a newer version
+// than this node knows gets protocolVersion, which HELLO reports back. One
+// older than minProtocolVersion is closed with 4014 and a reason naming the
+// supported range, so it can ask the user to update instead of failing on
+// events it does not understand.
+//
+// Every /ws event is checked against eventCatalog before its handler runs:
+// the type has to be known and the payload has to decode into the event's
+// payload type with its required fields set. Frames that fail, and values a
+// handler refuses, are answered with
+//
+//	ERROR  {code, message, eventType?, field?, nonce?}
+//
+// where nonce echoes the nonce of the offending event's envelope.
+
+const (
+	protocolVersion       = 1
+	minProtocolVersion    = 1
+	legacyProtocolVersion = 1
+
+	closeUnsupportedProtocol = 4014
+
+	errorEvent = "ERROR"
+
+	errorMalformedFrame = "MALFORMED_FRAME"
+	errorUnknownEvent   = "UNKNOWN_EVENT"
+	errorInvalidPayload = "INVALID_PAYLOAD"
+	errorInvalidValue   = "INVALID_VALUE"
+	errorLimitExceeded  = "LIMIT_EXCEEDED"
+	errorUnsupported    = "UNSUPPORTED"
+)
+
+type GatewayError struct {
+	Code      string          `json:"code"`
+	Message   string          `json:"message"`
+	EventType string          `json:"eventType,omitempty"`
+	Field     string          `json:"field,omitempty"`
+	Nonce     json.RawMessage `json:"nonce,omitempty"`
+}
+
+// eventSpec describes a client event. payload is a zero value of the type the
+// payload has to decode into; events without one ignore their payload.
+type eventSpec struct {
+	handler  EventHandler
+	payload  interface{}
+	required []string
+}
+
+// fieldError is a rejection that can be pinned on one payload field.
+type fieldError struct {
+	field   string
+	message string
+}
+
+func (e *fieldError) Error() string {
+	return e.message
+}
+
+func invalidField(field, format string, args ...interface{}) error {
+	return &fieldError{field: field, message: fmt.Sprintf(format, args...)}
+}
+
+// negotiateProtocolVersion picks the version spoken with the client and
+// reports whether the client is still supported.
+func negotiateProtocolVersion(r *http.Request) (int, bool) {
+	requested := legacyProtocolVersion
+	if v := r.URL.Query().Get("v"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, false
+		}
+		requested = n
+	}
+	if requested < minProtocolVersion {
+		return requested, false
+	}
+	if requested > protocolVersion {
+		return protocolVersion, true
+	}
+	return requested, true
+}
+
+func closeUnsupportedVersion(conn *websocket.Conn) {
+	reason := fmt.Sprintf("unsupported protocol version, supported %d-%d", minProtocolVersion, protocolVersion)
+	closing := websocket.FormatCloseMessage(closeUnsupportedProtocol, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(pingTimeout))
+	conn.Close()
+}
+
+// validate checks the event's payload against the spec. A missing payload is
+// replaced with an empty object so handlers can always decode it.
+func (s eventSpec) validate(event *EventMessage) error {
+	if s.payload == nil {
+		return nil
+	}
+
+	raw := bytes.TrimSpace(event.Payload)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		if len(s.required) > 0 {
+			return invalidField(s.required[0], "%s is required", s.required[0])
+		}
+		event.Payload = json.RawMessage("{}")
+		return nil
+	}
+	if raw[0] != '{' {
+		return errors.New("payload must be an object")
+	}
+
+	if err := json.Unmarshal(raw, reflect.New(reflect.TypeOf(s.payload)).Interface()); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return invalidField(typeErr.Field, "%s must be %s", typeErr.Field, jsonKind(typeErr.Type))
+		}
+		return errors.New("payload is not valid JSON")
+	}
+
+	if len(s.required) > 0 {
+		var fields map[string]json.RawMessage
+		_ = json.Unmarshal(raw, &fields)
+		for _, name := range s.required {
+			value, ok := fields[name]
+			if !ok || string(value) == "null" || string(value) == `""` {
+				return invalidField(name, "%s is required", name)
+			}
+		}
+	}
+	return nil
+}
+
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// sendError answers the event with ERROR.
+func sendError(ws *WSConnection, event EventMessage, code string, err error) {
+	response := GatewayError{
+		Code:      code,
+		Message:   err.Error(),
+		EventType: event.EventType,
+		Nonce:     event.Nonce,
+	}
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		response.Field = fe.field
+	}
+	writeToConn(ws, errorEvent, response)
+}
+
+// rejectEvent is sendError for handlers, which only know the raw connection.
+func rejectEvent(conn *websocket.Conn, userId string, event EventMessage, code string, err error) {
+	if ws := findConnection(userId, conn); ws != nil {
+		sendError(ws, event, code, err)
+	}
+}
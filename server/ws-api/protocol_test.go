@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEventSpecValidate(t *testing.T) {
+	status := eventCatalog["UPDATE_USER_STATUS"]
+	typingSettings := eventCatalog["UPDATE_TYPING_SETTINGS"]
+	heartbeat := eventCatalog["HEARTBEAT"]
+	activity := eventCatalog["ACTIVITY"]
+
+	tests := []struct {
+		name        string
+		spec        eventSpec
+		payload     string
+		wantErr     bool
+		wantField   string
+		wantPayload string
+	}{
+		{name: "valid", spec: status, payload: `{"status":"dnd"}`},
+		{name: "valid with optional field", spec: status, payload: `{"status":"dnd","expiresAt":123}`},
+		{name: "unknown fields are ignored", spec: status, payload: `{"status":"dnd","extra":true}`},
+		{name: "missing required field", spec: status, payload: `{"expiresAt":123}`, wantErr: true, wantField: "status"},
+		{name: "null required field", spec: status, payload: `{"status":null}`, wantErr: true, wantField: "status"},
+		{name: "empty required string", spec: status, payload: `{"status":""}`, wantErr: true, wantField: "status"},
+		{name: "false is a present boolean", spec: typingSettings, payload: `{"shareTyping":false}`},
+		{name: "wrong type", spec: status, payload: `{"status":5}`, wantErr: true, wantField: "status"},
+		{name: "wrong integer type", spec: status, payload: `{"status":"dnd","expiresAt":"soon"}`, wantErr: true, wantField: "expiresAt"},
+		{name: "not an object", spec: status, payload: `["dnd"]`, wantErr: true},
+		{name: "invalid JSON", spec: status, payload: `{"status":`, wantErr: true},
+		{name: "missing payload with required fields", spec: status, payload: ``, wantErr: true, wantField: "status"},
+		{name: "missing payload without required fields", spec: heartbeat, payload: ``, wantPayload: `{}`},
+		{name: "null payload without required fields", spec: heartbeat, payload: `null`, wantPayload: `{}`},
+		{name: "event without payload type", spec: activity, payload: `"anything"`, wantPayload: `"anything"`},
+	}
+
+	for _, tt := range tests {
+		event := EventMessage{EventType: "TEST", Payload: json.RawMessage(tt.payload)}
+		err := tt.spec.validate(&event)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validate = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		var fe *fieldError
+		if tt.wantField != "" && (!errors.As(err, &fe) || fe.field != tt.wantField) {
+			t.Errorf("%s: error %v does not name field %q", tt.name, err, tt.wantField)
+		}
+		if tt.wantPayload != "" && string(event.Payload) != tt.wantPayload {
+			t.Errorf("%s: payload = %s, want %s", tt.name, event.Payload, tt.wantPayload)
+		}
+	}
+}
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	tests := []struct {
+		query         string
+		wantVersion   int
+		wantSupported bool
+	}{
+		{"", legacyProtocolVersion, true},
+		{"?v=1", 1, true},
+		{"?v=99", protocolVersion, true},
+		{"?v=0", 0, false},
+		{"?v=abc", 0, false},
+	}
+	for _, tt := range tests {
+		version, supported := negotiateProtocolVersion(httptest.NewRequest("GET", "/ws"+tt.query, nil))
+		if version != tt.wantVersion || supported != tt.wantSupported {
+			t.Errorf("%q: got (%d, %v), want (%d, %v)", tt.query, version, supported, tt.wantVersion, tt.wantSupported)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client events are throttled with a token bucket per user and per kind of
+// event, shared by all of the user's connections. A rejected event is dropped
+// and answered once with RATE_LIMITED; a user who keeps getting rejected is
+// disconnected.
+
+const (
+	closeRateLimited = 4010
+
+	rateLimitSweepInterval = time.Minute
+)
+
+// rateLimitRule allows Count events per Window, refilled continuously. A zero
+// Count disables the limit.
+type rateLimitRule struct {
+	Count  int
+	Window time.Duration
+}
+
+type RateLimitedResponse struct {
+	EventType    string `json:"eventType"`
+	RetryAfterMs int64  `json:"retryAfterMs"`
+}
+
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	window   time.Duration
+	notified bool
+}
+
+type violationCounter struct {
+	count int
+	since time.Time
+}
+
+type rateLimiter struct {
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket
+	violations map[string]*violationCounter
+}
+
+var limiter = &rateLimiter{
+	buckets:    make(map[string]*tokenBucket),
+	violations: make(map[string]*violationCounter),
+}
+
+// IDENTIFY is never limited. HEARTBEAT and RESUME share a generous bucket of
+// their own so a well behaved client never hits it; anything not listed here
+// falls back to DefaultRateLimit.
+var rateLimitExempt = map[string]bool{
+	"IDENTIFY": true,
+}
+
+func rateLimitGroup(eventType string) (string, rateLimitRule) {
+	switch eventType {
+	case "HEARTBEAT", "RESUME":
+		return "heartbeat", cfg.HeartbeatRateLimit
+	case "START_TYPING", "STOP_TYPING":
+		return "typing", cfg.TypingRateLimit
+	case "UPDATE_USER_STATUS":
+		return "status", cfg.StatusUpdateRateLimit
+	case "GET_USER_STATUS":
+		return "status_query", cfg.StatusQueryRateLimit
+	default:
+		return "default", cfg.DefaultRateLimit
+	}
+}
+
+type rateLimitDecision struct {
+	allowed    bool
+	retryAfter time.Duration
+	notify     bool
+	disconnect bool
+}
+
+func (l *rateLimiter) take(userId, eventType string, now time.Time) rateLimitDecision {
+	if rateLimitExempt[eventType] {
+		return rateLimitDecision{allowed: true}
+	}
+	group, rule := rateLimitGroup(eventType)
+	if rule.Count <= 0 || rule.Window <= 0 {
+		return rateLimitDecision{allowed: true}
+	}
+	perSecond := float64(rule.Count) / rule.Window.Seconds()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := userId + "|" + group
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(rule.Count), last: now, window: rule.Window}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * perSecond
+	if b.tokens > float64(rule.Count) {
+		b.tokens = float64(rule.Count)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.notified = false
+		return rateLimitDecision{allowed: true}
+	}
+
+	decision := rateLimitDecision{
+		retryAfter: time.Duration((1 - b.tokens) / perSecond * float64(time.Second)),
+		notify:     !b.notified,
+	}
+	b.notified = true
+
+	v, ok := l.violations[userId]
+	if !ok || now.Sub(v.since) > cfg.RateLimitViolationWindow {
+		v = &violationCounter{since: now}
+		l.violations[userId] = v
+	}
+	v.count++
+	decision.disconnect = cfg.RateLimitMaxViolations > 0 && v.count >= cfg.RateLimitMaxViolations
+	if decision.disconnect {
+		delete(l.violations, userId)
+	}
+	return decision
+}
+
+// sweep drops buckets that have refilled completely and expired violation
+// counters, so idle users do not keep state around.
+func (l *rateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > b.window {
+			delete(l.buckets, key)
+		}
+	}
+	for userId, v := range l.violations {
+		if now.Sub(v.since) > cfg.RateLimitViolationWindow {
+			delete(l.violations, userId)
+		}
+	}
+}
+
+func startRateLimitSweeper() {
+	go func() {
+		ticker := time.NewTicker(rateLimitSweepInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			limiter.sweep(now)
+		}
+	}()
+}
+
+// checkRateLimit reports whether the event may be handled, telling the client
+// when it is not and disconnecting repeat offenders.
+func checkRateLimit(ws *WSConnection, userId, eventType string) bool {
+	decision := limiter.take(userId, eventType, time.Now())
+	if decision.allowed {
+		return true
+	}
+
+	if decision.disconnect {
+		fmt.Printf("Disconnecting user %s for exceeding rate limits on %s\n", userId, eventType)
+		ws.closeWithCode(closeRateLimited, "rate limited")
+		return false
+	}
+	if decision.notify {
+		writeToConn(ws, "RATE_LIMITED", RateLimitedResponse{
+			EventType:    eventType,
+			RetryAfterMs: decision.retryAfter.Milliseconds(),
+		})
+	}
+	return false
+}
+
+// getEnvRateLimit reads a limit written as "count/seconds", e.g. "10/5".
+func getEnvRateLimit(key string, defaultValue rateLimitRule) rateLimitRule {
+	value := os.Getenv(key)
+	countStr, secondsStr, ok := strings.Cut(value, "/")
+	if !ok {
+		return defaultValue
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(countStr))
+	if err != nil || count < 0 {
+		return defaultValue
+	}
+	seconds, err := strconv.Atoi(strings.TrimSpace(secondsStr))
+	if err != nil || seconds <= 0 {
+		return defaultValue
+	}
+	return rateLimitRule{Count: count, Window: time.Duration(seconds) * time.Second}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLimiter(t *testing.T) *rateLimiter {
+	t.Helper()
+	previous := cfg
+	t.Cleanup(func() { cfg = previous })
+	cfg.HeartbeatRateLimit = rateLimitRule{Count: 3, Window: 30 * time.Second}
+	cfg.TypingRateLimit = rateLimitRule{Count: 3, Window: 3 * time.Second}
+	cfg.StatusUpdateRateLimit = rateLimitRule{Count: 0, Window: time.Second}
+	cfg.DefaultRateLimit = rateLimitRule{Count: 2, Window: 10 * time.Second}
+	cfg.RateLimitMaxViolations = 4
+	cfg.RateLimitViolationWindow = time.Minute
+	return &rateLimiter{
+		buckets:    make(map[string]*tokenBucket),
+		violations: make(map[string]*violationCounter),
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	type step struct {
+		after      time.Duration
+		userId     string
+		eventType  string
+		allowed    bool
+		notify     bool
+		disconnect bool
+		retryAfter time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"burst up to the count", []step{
+			{0, "u", "START_TYPING", true, false, false, 0},
+			{0, "u", "START_TYPING", true, false, false, 0},
+			{0, "u", "START_TYPING", true, false, false, 0},
+			{0, "u", "START_TYPING", false, true, false, time.Second},
+		}},
+		{"notified once per rejection streak", []step{
+			{0, "u", "SUBSCRIBE", true, false, false, 0},
+			{0, "u", "SUBSCRIBE", true, false, false, 0},
+			{0, "u", "SUBSCRIBE", false, true, false, 5 * time.Second},
+			{0, "u", "SUBSCRIBE", false, false, false, 5 * time.Second},
+			{5 * time.Second, "u", "SUBSCRIBE", true, false, false, 0},
+			{0, "u", "SUBSCRIBE", false, true, false, 5 * time.Second},
+		}},
+		{"refills continuously", []step{
+			{0, "u", "STOP_TYPING", true, false, false, 0},
+			{0, "u", "STOP_TYPING", true, false, false, 0},
+			{0, "u", "STOP_TYPING", true, false, false, 0},
+			{500 * time.Millisecond, "u", "STOP_TYPING", false, true, false, 500 * time.Millisecond},
+			{500 * time.Millisecond, "u", "STOP_TYPING", true, false, false, 0},
+		}},
+		{"never refills past the count", []step{
+			{time.Hour, "u", "START_TYPING", true, false, false, 0},
+			{0, "u", "START_TYPING", true, false, false, 0},
+			{0, "u", "START_TYPING", true, false, false, 0},
+			{0, "u", "START_TYPING", false, true, false, time.Second},
+		}},
+		{"typing events share a bucket", []step{
+			{0, "u", "START_TYPING", true, false, false, 0},
+			{0, "u", "STOP_TYPING", true, false, false, 0},
+			{0, "u", "START_TYPING", true, false, false, 0},
+			{0, "u", "STOP_TYPING", false, true, false, time.Second},
+		}},
+		{"heartbeats and resumes share a bucket", []step{
+			{0, "u", "HEARTBEAT", true, false, false, 0},
+			{0, "u", "RESUME", true, false, false, 0},
+			{0, "u", "HEARTBEAT", true, false, false, 0},
+			{0, "u", "RESUME", false, true, false, 10 * time.Second},
+			{10 * time.Second, "u", "HEARTBEAT", true, false, false, 0},
+			{0, "u", "SUBSCRIBE", true, false, false, 0},
+		}},
+		{"identify is exempt", []step{
+			{0, "u", "IDENTIFY", true, false, false, 0},
+			{0, "u", "IDENTIFY", true, false, false, 0},
+			{0, "u", "IDENTIFY", true, false, false, 0},
+			{0, "u", "IDENTIFY", true, false, false, 0},
+		}},
+		{"groups and users are separate", []step{
+			{0, "u", "SUBSCRIBE", true, false, false, 0},
+			{0, "u", "SUBSCRIBE", true, false, false, 0},
+			{0, "u", "START_TYPING", true, false, false, 0},
+			{0, "other", "SUBSCRIBE", true, false, false, 0},
+		}},
+		{"zero count disables the limit", []step{
+			{0, "u", "UPDATE_USER_STATUS", true, false, false, 0},
+			{0, "u", "UPDATE_USER_STATUS", true, false, false, 0},
+			{0, "u", "UPDATE_USER_STATUS", true, false, false, 0},
+		}},
+		{"repeat offenders are disconnected", []step{
+			{0, "u", "SUBSCRIBE", true, false, false, 0},
+			{0, "u", "SUBSCRIBE", true, false, false, 0},
+			{0, "u", "SUBSCRIBE", false, true, false, 5 * time.Second},
+			{0, "u", "SUBSCRIBE", false, false, false, 5 * time.Second},
+			{0, "u", "SUBSCRIBE", false, false, false, 5 * time.Second},
+			{0, "u", "SUBSCRIBE", false, false, true, 5 * time.Second},
+		}},
+		{"violations expire", []step{
+			{0, "u", "SUBSCRIBE", true, false, false, 0},
+			{0, "u", "SUBSCRIBE", true, false, false, 0},
+			{0, "u", "SUBSCRIBE", false, true, false, 5 * time.Second},
+			{0, "u", "SUBSCRIBE", false, false, false, 5 * time.Second},
+			{0, "u", "SUBSCRIBE", false, false, false, 5 * time.Second},
+			{2 * time.Minute, "u", "SUBSCRIBE", true, false, false, 0},
+			{0, "u", "SUBSCRIBE", true, false, false, 0},
+			{0, "u", "SUBSCRIBE", false, true, false, 5 * time.Second},
+		}},
+	}
+
+	for _, tt := range tests {
+		l := newTestLimiter(t)
+		now := start
+		for i, s := range tt.steps {
+			now = now.Add(s.after)
+			got := l.take(s.userId, s.eventType, now)
+			want := rateLimitDecision{allowed: s.allowed, notify: s.notify, disconnect: s.disconnect, retryAfter: s.retryAfter}
+			if got != want {
+				t.Errorf("%s: step %d (%s): got %+v, want %+v", tt.name, i, s.eventType, got, want)
+			}
+		}
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := newTestLimiter(t)
+	now := time.Unix(1_700_000_000, 0)
+	l.take("idle", "SUBSCRIBE", now)
+	l.take("busy", "SUBSCRIBE", now.Add(55*time.Second))
+	l.take("busy", "SUBSCRIBE", now.Add(55*time.Second))
+	l.take("busy", "SUBSCRIBE", now.Add(55*time.Second))
+
+	l.sweep(now.Add(60 * time.Second))
+	if _, ok := l.buckets["idle|default"]; ok {
+		t.Error("refilled bucket was kept")
+	}
+	if _, ok := l.buckets["busy|default"]; !ok {
+		t.Error("recent bucket was dropped")
+	}
+	if _, ok := l.violations["busy"]; !ok {
+		t.Error("recent violation was dropped")
+	}
+	l.sweep(now.Add(3 * time.Minute))
+	if len(l.buckets) != 0 || len(l.violations) != 0 {
+		t.Errorf("state left after everything expired: %d buckets, %d violations", len(l.buckets), len(l.violations))
+	}
+}
+
+func TestGetEnvRateLimit(t *testing.T) {
+	fallback := rateLimitRule{Count: 7, Window: 7 * time.Second}
+	tests := []struct {
+		value string
+		want  rateLimitRule
+	}{
+		{"10/5", rateLimitRule{Count: 10, Window: 5 * time.Second}},
+		{" 3 / 60 ", rateLimitRule{Count: 3, Window: time.Minute}},
+		{"0/10", rateLimitRule{Count: 0, Window: 10 * time.Second}},
+		{"", fallback},
+		{"10", fallback},
+		{"-1/5", fallback},
+		{"10/0", fallback},
+		{"ten/5", fallback},
+	}
+	for _, tt := range tests {
+		t.Setenv("TestRateLimitRule", tt.value)
+		if got := getEnvRateLimit("TestRateLimitRule", fallback); got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Read state is synced through the gateway. MESSAGE_ACK records the last
+// message a user read in a channel and is echoed to their other sessions.
+// Acking a DM also sends READ_RECEIPT to the other participant unless the
+// reader turned receipts off. As with typing, a DM channel is addressed by
+// the other user's id.
+//
+//	read_state:{userId}        hash of channelId -> ReadStateEntry
+//	read_receipts:{userId}     hash of peerId -> ReadReceipt the peer sent
+//	read_receipts_disabled     users who do not send read receipts
+
+const (
+	readStatePrefix          = "read_state:"
+	readReceiptsPrefix       = "read_receipts:"
+	readReceiptsDisabledKey  = "read_receipts_disabled"
+	messageAckEvent          = "MESSAGE_ACK"
+	readReceiptEvent         = "READ_RECEIPT"
+	readReceiptSettingsEvent = "READ_RECEIPT_SETTINGS"
+)
+
+type MessageAckPayload struct {
+	ChannelId string `json:"channelId"`
+	GuildId   string `json:"guildId,omitempty"`
+	MessageId string `json:"messageId"`
+}
+
+type ReadStateEntry struct {
+	ChannelId string `json:"channelId"`
+	GuildId   string `json:"guildId,omitempty"`
+	MessageId string `json:"messageId"`
+	AckedAt   int64  `json:"ackedAt"`
+}
+
+// MessageAckResponse is what the user's other sessions receive. SessionId
+// names the session that acked so it is not echoed back to it.
+type MessageAckResponse struct {
+	ReadStateEntry
+	SessionId string `json:"sessionId,omitempty"`
+}
+
+type ReadReceipt struct {
+	ChannelId string `json:"channelId"`
+	UserId    string `json:"userId"`
+	MessageId string `json:"messageId"`
+	ReadAt    int64  `json:"readAt"`
+}
+
+type ReadReceiptSettings struct {
+	SendReadReceipts bool `json:"sendReadReceipts"`
+}
+
+type ReadStateSnapshot struct {
+	Entries          []ReadStateEntry `json:"entries"`
+	Receipts         []ReadReceipt    `json:"receipts"`
+	SendReadReceipts bool             `json:"sendReadReceipts"`
+}
+
+func handleMessageAck(conn *websocket.Conn, event EventMessage, userId string) {
+	var ack MessageAckPayload
+	if err := unmarshalPayload(event, &ack); err != nil || ack.ChannelId == "" || ack.MessageId == "" {
+		return
+	}
+
+	isDm := ack.GuildId == ""
+	if isDm && !memberships.areDmPeers(userId, ack.ChannelId) {
+		return
+	}
+	if !isDm && !memberships.isMember(ack.GuildId, userId) {
+		return
+	}
+
+	entry := ReadStateEntry{
+		ChannelId: ack.ChannelId,
+		GuildId:   ack.GuildId,
+		MessageId: ack.MessageId,
+		AckedAt:   time.Now().UnixMilli(),
+	}
+	if err := redisClient.HSet(ctx, readStatePrefix+userId, ack.ChannelId, []byte(mustJSON(entry))).Err(); err != nil {
+		logErr("Error saving read state", err)
+		return
+	}
+
+	response := MessageAckResponse{ReadStateEntry: entry}
+	if ws := findConnection(userId, conn); ws != nil {
+		if session := ws.session(); session != nil {
+			response.SessionId = session.ID
+		}
+	}
+	deliverToUsers(messageAckEvent, response, []string{userId})
+	clearMentions(userId, ack.GuildId, ack.ChannelId)
+
+	if isDm && sendsReadReceipts(userId) {
+		sendReadReceipt(userId, ack.ChannelId, ack.MessageId, entry.AckedAt)
+	}
+}
+
+func sendReadReceipt(readerId, peerId, messageId string, readAt int64) {
+	receipt := ReadReceipt{
+		ChannelId: readerId,
+		UserId:    readerId,
+		MessageId: messageId,
+		ReadAt:    readAt,
+	}
+	if err := redisClient.HSet(ctx, readReceiptsPrefix+peerId, readerId, []byte(mustJSON(receipt))).Err(); err != nil {
+		logErr("Error saving read receipt", err)
+	}
+	deliverToUsers(readReceiptEvent, receipt, []string{peerId})
+}
+
+// handleUpdateReadReceiptSettings turns sending read receipts on or off. The
+// setting is echoed to all of the user's sessions.
+func handleUpdateReadReceiptSettings(conn *websocket.Conn, event EventMessage, userId string) {
+	var settings ReadReceiptSettings
+	if err := unmarshalPayload(event, &settings); err != nil {
+		rejectEvent(conn, userId, event, errorInvalidPayload, err)
+		return
+	}
+
+	var err error
+	if settings.SendReadReceipts {
+		err = redisClient.SRem(ctx, readReceiptsDisabledKey, userId).Err()
+	} else {
+		err = redisClient.SAdd(ctx, readReceiptsDisabledKey, userId).Err()
+	}
+	if err != nil {
+		logErr("Error saving read receipt settings", err)
+		return
+	}
+
+	deliverToUsers(readReceiptSettingsEvent, settings, []string{userId})
+}
+
+func sendsReadReceipts(userId string) bool {
+	disabled, err := redisClient.SIsMember(ctx, readReceiptsDisabledKey, userId).Result()
+	return err != nil || !disabled
+}
+
+// handleGetReadState answers with everything a reconnecting session needs to
+// rebuild its unread markers and DM receipts.
+func handleGetReadState(conn *websocket.Conn, event EventMessage, userId string) {
+	ws := findConnection(userId, conn)
+	if ws == nil {
+		return
+	}
+
+	pipe := redisClient.Pipeline()
+	state := pipe.HGetAll(ctx, readStatePrefix+userId)
+	receipts := pipe.HGetAll(ctx, readReceiptsPrefix+userId)
+	disabled := pipe.SIsMember(ctx, readReceiptsDisabledKey, userId)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error reading read state", err)
+		return
+	}
+
+	snapshot := ReadStateSnapshot{
+		Entries:          []ReadStateEntry{},
+		Receipts:         []ReadReceipt{},
+		SendReadReceipts: !disabled.Val(),
+	}
+	for _, raw := range state.Val() {
+		var entry ReadStateEntry
+		if json.Unmarshal([]byte(raw), &entry) == nil {
+			snapshot.Entries = append(snapshot.Entries, entry)
+		}
+	}
+	for _, raw := range receipts.Val() {
+		var receipt ReadReceipt
+		if json.Unmarshal([]byte(raw), &receipt) == nil {
+			snapshot.Receipts = append(snapshot.Receipts, receipt)
+		}
+	}
+
+	writeToConn(ws, "READ_STATE", snapshot)
+}
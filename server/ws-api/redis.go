@@ -4,18 +4,25 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/gorilla/websocket"
 )
 
 var redisClient *redis.Client
 var ctx = context.Background()
 
+// streamCtx is cancelled on shutdown to stop reading event_stream; entries
+// already read are still processed and acknowledged under ctx.
+var (
+	streamCtx, cancelStream = context.WithCancel(ctx)
+	streamConsumerDone      = make(chan struct{})
+)
+
 func initRedisClient(redisURL string) error {
 	options, err := parseRedisURL(redisURL)
 	if err != nil {
@@ -32,48 +39,255 @@ func initRedisClient(redisURL string) error {
 	return nil
 }
 
+const (
+	eventStreamName      = "event_stream"
+	deadLetterStreamName = "event_stream:dead"
+	streamReadBlock      = 5 * time.Second
+	streamReadCount      = 100
+	streamInitialBackoff = time.Second
+	streamMaxBackoff     = 30 * time.Second
+)
+
+// consumeMessagesFromRedis reads event_stream through a consumer group so the
+// read position lives in Redis instead of on local disk. Entries are only
+// acknowledged once they have been fanned out, and entries left pending by a
+// crashed consumer are claimed after StreamClaimIdle. Read errors never stop
+// the consumer; it reconnects with exponential backoff.
 func consumeMessagesFromRedis() {
-	streamName := "event_stream"
+	defer close(streamConsumerDone)
+	backoff := streamInitialBackoff
 
-	lastID, err := loadLastID()
-	if err != nil {
-		logErr("Error loading last ID from file", err)
-		lastID = "0"
+	for streamCtx.Err() == nil {
+		if err := ensureConsumerGroup(); err != nil {
+			logErr("Error creating Redis consumer group", err)
+			backoff = waitBackoff(backoff)
+			continue
+		}
+
+		if err := consumeStream(); err != nil {
+			if streamCtx.Err() != nil {
+				return
+			}
+			logErr("Error reading from Redis stream", err)
+			backoff = waitBackoff(backoff)
+			continue
+		}
+		backoff = streamInitialBackoff
 	}
+}
+
+func waitBackoff(backoff time.Duration) time.Duration {
+	fmt.Printf("Retrying Redis stream consumer in %s\n", backoff)
+	select {
+	case <-streamCtx.Done():
+	case <-time.After(backoff):
+	}
+	backoff *= 2
+	if backoff > streamMaxBackoff {
+		backoff = streamMaxBackoff
+	}
+	return backoff
+}
+
+// ensureConsumerGroup creates the group if it does not exist yet. The .NET
+// API puts a TTL on event_stream, so the group can disappear along with the
+// stream and has to be recreated. A new group starts at the end of the
+// stream: replaying whatever history is still retained would push stale
+// events to everyone who is connected.
+func ensureConsumerGroup() error {
+	err := redisClient.XGroupCreateMkStream(ctx, eventStreamName, cfg.StreamConsumerGroup, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+func consumeStream() error {
+	// Entries delivered to this consumer before a restart come first.
+	if err := drainPending(); err != nil {
+		return err
+	}
+	lastClaim := time.Now()
 
 	for {
-		messages, err := readFromRedisStream(streamName, lastID)
+		if time.Since(lastClaim) >= cfg.StreamClaimIdle {
+			if err := claimStalePending(); err != nil {
+				return err
+			}
+			lastClaim = time.Now()
+		}
+
+		streams, err := readFromRedisStream(">", streamReadBlock)
+		if err == redis.Nil {
+			continue
+		}
 		if err != nil {
-			logErr("Error reading from Redis stream", err)
-			return
+			return err
 		}
+		processStreams(streams)
+	}
+}
 
-		for _, msg := range messages {
-			for _, xMessage := range msg.Messages {
-				eventMessage, userIDs, err := parseRedisMessage(xMessage)
-				if err != nil {
-					logErr("Error parsing message", err)
-					continue
-				}
+// drainPending processes the entries pending on this consumer, walking the
+// pending list once so an entry whose XACK keeps failing is not read again
+// until the next drain. Entries delivered more than StreamMaxDeliveries
+// times are moved to event_stream:dead instead of being processed again.
+func drainPending() error {
+	start := "0"
+	for {
+		streams, err := readFromRedisStream(start, -1)
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-				printEventDetails(eventMessage, userIDs)
-				broadcastToUsers(eventMessage, userIDs)
+		var messages []redis.XMessage
+		for _, stream := range streams {
+			messages = append(messages, stream.Messages...)
+		}
+		if len(messages) == 0 {
+			return nil
+		}
 
-				lastID = xMessage.ID
-				if err := saveLastID(lastID); err != nil {
-					logErr("Error saving last ID to file", err)
-				}
+		deliveries, err := deliveryCounts(messages[0].ID, messages[len(messages)-1].ID, len(messages))
+		if err != nil {
+			return err
+		}
+		for _, xMessage := range messages {
+			if count := deliveries[xMessage.ID]; cfg.StreamMaxDeliveries > 0 && count > int64(cfg.StreamMaxDeliveries) {
+				deadLetter(xMessage, fmt.Errorf("delivered %d times without being acknowledged", count))
+				ackStreamMessage(xMessage.ID)
+				continue
 			}
+			processStreamMessage(xMessage)
 		}
+		start = messages[len(messages)-1].ID
 	}
 }
 
-func readFromRedisStream(streamName, lastID string) ([]redis.XStream, error) {
-	return redisClient.XRead(ctx, &redis.XReadArgs{
-		Streams: []string{streamName, lastID},
-		Block:   0,
-		Count:   100,
+// deliveryCounts returns how often each entry between start and end that is
+// pending on this consumer has been delivered.
+func deliveryCounts(start, end string, count int) (map[string]int64, error) {
+	pending, err := redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   eventStreamName,
+		Group:    cfg.StreamConsumerGroup,
+		Start:    start,
+		End:      end,
+		Count:    int64(count),
+		Consumer: cfg.StreamConsumerName,
 	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(pending))
+	for _, entry := range pending {
+		counts[entry.ID] = entry.RetryCount
+	}
+	return counts, nil
+}
+
+// claimStalePending moves entries that have been pending on other consumers
+// for longer than StreamClaimIdle to this consumer and processes them. The
+// command is sent raw because XAUTOCLAIM replies gained a third element in
+// Redis 7, which the typed go-redis helper rejects.
+func claimStalePending() error {
+	start := "0-0"
+	for {
+		reply, err := redisClient.Do(ctx, "XAUTOCLAIM", eventStreamName, cfg.StreamConsumerGroup,
+			cfg.StreamConsumerName, cfg.StreamClaimIdle.Milliseconds(), start,
+			"COUNT", streamReadCount, "JUSTID").Slice()
+		if err != nil {
+			return err
+		}
+		if len(reply) < 2 {
+			return fmt.Errorf("unexpected XAUTOCLAIM reply: %v", reply)
+		}
+
+		next, _ := reply[0].(string)
+		claimed, _ := reply[1].([]interface{})
+		if len(claimed) > 0 {
+			fmt.Printf("Claimed %d stale entries from %s\n", len(claimed), eventStreamName)
+		}
+
+		if next == "" || next == "0-0" {
+			break
+		}
+		start = next
+	}
+	return drainPending()
+}
+
+// stopStreamConsumer stops reading new entries and waits, at most until
+// deadline, for the current batch to be processed and acknowledged.
+func stopStreamConsumer(deadline context.Context) {
+	cancelStream()
+	select {
+	case <-streamConsumerDone:
+	case <-deadline.Done():
+		fmt.Println("Stream consumer did not stop in time, unacknowledged entries will be claimed")
+	}
+}
+
+func readFromRedisStream(id string, block time.Duration) ([]redis.XStream, error) {
+	return redisClient.XReadGroup(streamCtx, &redis.XReadGroupArgs{
+		Group:    cfg.StreamConsumerGroup,
+		Consumer: cfg.StreamConsumerName,
+		Streams:  []string{eventStreamName, id},
+		Count:    streamReadCount,
+		Block:    block,
+	}).Result()
+}
+
+func processStreams(streams []redis.XStream) {
+	for _, stream := range streams {
+		for _, xMessage := range stream.Messages {
+			processStreamMessage(xMessage)
+		}
+	}
+}
+
+func processStreamMessage(xMessage redis.XMessage) {
+	eventMessage, userIDs, err := parseRedisMessage(xMessage)
+	if err != nil {
+		logErr("Error parsing message "+xMessage.ID, err)
+		deadLetter(xMessage, err)
+	} else if !applyRevocationEvent(eventMessage) {
+		if cfg.DebugEventDump {
+			printEventDetails(eventMessage, userIDs)
+		}
+		memberships.applyEvent(eventMessage, userIDs)
+		cluster.relayMemberEvent(eventMessage, userIDs)
+		broadcastToUsers(eventMessage, userIDs)
+		applyMentionEvent(eventMessage, userIDs)
+	}
+
+	ackStreamMessage(xMessage.ID)
+}
+
+func ackStreamMessage(id string) {
+	if err := redisClient.XAck(ctx, eventStreamName, cfg.StreamConsumerGroup, id).Err(); err != nil {
+		logErr("Error acknowledging message "+id, err)
+	}
+}
+
+// deadLetter copies a malformed entry to event_stream:dead together with the
+// reason it was rejected, so it can be inspected instead of being lost.
+func deadLetter(xMessage redis.XMessage, reason error) {
+	values := make(map[string]interface{}, len(xMessage.Values)+3)
+	for k, v := range xMessage.Values {
+		values[k] = v
+	}
+	values["OriginalID"] = xMessage.ID
+	values["Error"] = reason.Error()
+	values["Consumer"] = cfg.StreamConsumerName
+
+	err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: deadLetterStreamName,
+		Values: values,
+	}).Err()
+	logErr("Error writing to dead-letter stream", err)
 }
 
 func parseRedisMessage(xMessage redis.XMessage) (EventMessage, []string, error) {
@@ -117,13 +331,24 @@ func printEventDetails(event EventMessage, userIDs []string) {
 }
 
 func broadcastToUsers(eventMessage EventMessage, userIDs []string) {
-	payload, err := json.Marshal(eventMessage)
-	if err != nil {
-		fmt.Printf("Error marshalling message: %v\n", err)
-		return
-	}
+	deliverToUsers(eventMessage.EventType, eventMessage.Payload, userIDs)
+}
+
+// deliverToUsers sends the event to the target users' sessions on this node
+// and, in cluster mode, to the nodes holding the rest of them.
+func deliverToUsers(eventType string, payload interface{}, userIDs []string) {
+	deliverLocal(eventType, payload, userIDs)
+	cluster.routeToUsers(eventType, payload, userIDs)
+}
 
+func deliverLocal(eventType string, payload interface{}, userIDs []string) {
+	inspector.observe(inspectDirectionOutbound, eventType, payload, userIDs)
+	scope := scopeOf(eventType, payload)
 	for _, targetUserID := range userIDs {
+		for _, session := range sessions.detachedForUser(targetUserID) {
+			_ = session.deliver(eventType, payload, scope)
+		}
+
 		hub.lock.RLock()
 		conns, ok := hub.clients[targetUserID]
 		hub.lock.RUnlock()
@@ -133,16 +358,29 @@ func broadcastToUsers(eventMessage EventMessage, userIDs []string) {
 
 		var failedConns []*WSConnection
 		for _, ws := range conns {
-			ws.Mutex.Lock()
-			err := ws.Conn.WriteMessage(websocket.TextMessage, payload)
-			ws.Mutex.Unlock()
+			var err error
+			if session := ws.session(); session != nil {
+				err = session.deliver(eventType, payload, scope)
+			} else {
+				err = writeToConn(ws, eventType, payload)
+			}
 
+			if errors.Is(err, errSendQueueFull) {
+				// enqueue already started closeSlowConsumer, which sends the
+				// 4008 close frame; closing here would race it off the wire.
+				fmt.Printf("Dropped message for slow consumer %s\n", targetUserID)
+				continue
+			}
 			if err != nil {
 				fmt.Printf("Error sending message to user %s: %v. Closing connection.\n", targetUserID, err)
+				ws.close()
 				ws.Conn.Close()
+				if session := ws.session(); session != nil {
+					session.detach(ws)
+				}
 				failedConns = append(failedConns, ws)
 			} else {
-				fmt.Printf("Successfully sent message to WebSocket client for userId %s\n", targetUserID)
+				fmt.Printf("Queued message for WebSocket client for userId %s\n", targetUserID)
 			}
 		}
 		if len(failedConns) > 0 {
@@ -211,20 +449,3 @@ func logErr(context string, err error) {
 		fmt.Printf("%s: %v\n", context, err)
 	}
 }
-
-const lastIDFile = "last_redis_id.txt"
-
-func saveLastID(lastID string) error {
-	return os.WriteFile(lastIDFile, []byte(lastID), 0644)
-}
-
-func loadLastID() (string, error) {
-	data, err := os.ReadFile(lastIDFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return "0", nil
-		}
-		return "", err
-	}
-	return strings.TrimSpace(string(data)), nil
-}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func addStreamEvent(t *testing.T) string {
+	t.Helper()
+	id, err := redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: eventStreamName,
+		Values: []interface{}{"EventType", "UPDATE_GUILD_NAME", "Payload", `{}`, "UserIDs", `["nobody"]`},
+	}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func pendingOnConsumer(t *testing.T) int {
+	t.Helper()
+	pending, err := redisClient.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: eventStreamName, Group: cfg.StreamConsumerGroup, Start: "-", End: "+", Count: 100,
+	}).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(pending)
+}
+
+func drainWithTimeout(t *testing.T) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- drainPending() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drainPending did not return")
+	}
+}
+
+func TestEnsureConsumerGroupStartsAtTheEnd(t *testing.T) {
+	startFakeRedis(t)
+	addStreamEvent(t)
+
+	if err := ensureConsumerGroup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureConsumerGroup(); err != nil {
+		t.Fatalf("existing group: %v", err)
+	}
+	if _, err := readFromRedisStream(">", -1); err != redis.Nil {
+		t.Fatalf("new group read history: %v", err)
+	}
+
+	addStreamEvent(t)
+	streams, err := readFromRedisStream(">", -1)
+	if err != nil || len(streams) != 1 || len(streams[0].Messages) != 1 {
+		t.Fatalf("entry added after the group was created: %v, %v", streams, err)
+	}
+}
+
+func TestDrainPendingReturnsWhenAckFails(t *testing.T) {
+	fake := startFakeRedis(t)
+	if err := ensureConsumerGroup(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		addStreamEvent(t)
+	}
+	if _, err := readFromRedisStream(">", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.fail("XACK", true)
+	drainWithTimeout(t)
+	if n := pendingOnConsumer(t); n != 3 {
+		t.Fatalf("%d entries pending, want all 3 left for the next drain", n)
+	}
+
+	fake.fail("XACK", false)
+	drainWithTimeout(t)
+	if n := pendingOnConsumer(t); n != 0 {
+		t.Fatalf("%d entries still pending after a successful drain", n)
+	}
+}
+
+func TestDrainPendingDeadLettersAfterMaxDeliveries(t *testing.T) {
+	fake := startFakeRedis(t)
+	previous := cfg
+	t.Cleanup(func() { cfg = previous })
+	cfg.StreamMaxDeliveries = 2
+
+	if err := ensureConsumerGroup(); err != nil {
+		t.Fatal(err)
+	}
+	id := addStreamEvent(t)
+	if _, err := readFromRedisStream(">", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.fail("XACK", true)
+	drainWithTimeout(t)
+	fake.fail("XACK", false)
+
+	if dead := len(fake.streamEntries(deadLetterStreamName)); dead != 0 {
+		t.Fatalf("entry dead-lettered after %d deliveries", 2)
+	}
+	// The third delivery is over the limit.
+	drainWithTimeout(t)
+
+	dead := fake.streamEntries(deadLetterStreamName)
+	if len(dead) != 1 {
+		t.Fatalf("%d dead-lettered entries, want 1", len(dead))
+	}
+	fields := map[string]string{}
+	for i := 0; i+1 < len(dead[0].fields); i += 2 {
+		fields[dead[0].fields[i]] = dead[0].fields[i+1]
+	}
+	if fields["OriginalID"] != id || fields["EventType"] != "UPDATE_GUILD_NAME" || fields["Error"] == "" {
+		t.Fatalf("dead letter = %v", fields)
+	}
+	if n := pendingOnConsumer(t); n != 0 {
+		t.Fatalf("dead-lettered entry still pending")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A socket is authorized with the token it connected with, so logging out,
+// changing a password or getting banned has to reach sockets that are
+// already open. The .NET API publishes on event_stream:
+//
+//	SESSION_REVOKED  {userId, tokenHash?}  one token, or all of them without tokenHash
+//	USER_BANNED      {userId, reason?}     every token of the user
+//
+// tokenHash is the hex SHA-256 of the token so tokens never travel through
+// Redis. Only one node reads each stream entry, so it relays the revocation
+// to every node; each evicts the tokens from its authenticator (see auth.go)
+// and closes the matching /ws and /video-ws sockets. On top of that every
+// open socket's token is re-checked against /auth/validate-token every
+// TokenRevalidateInterval.
+
+const (
+	sessionRevokedEvent = "SESSION_REVOKED"
+	userBannedEvent     = "USER_BANNED"
+
+	closeSessionRevoked = 4012
+	closeUserBanned     = 4013
+)
+
+var errInvalidSession = errors.New("invalid session")
+
+type RevocationPayload struct {
+	UserId    string `json:"userId"`
+	TokenHash string `json:"tokenHash,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Banned    bool   `json:"banned,omitempty"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// applyRevocationEvent handles a revocation read from event_stream and
+// reports whether the entry was one.
+func applyRevocationEvent(event EventMessage) bool {
+	if event.EventType != sessionRevokedEvent && event.EventType != userBannedEvent {
+		return false
+	}
+
+	var revocation RevocationPayload
+	if err := json.Unmarshal(event.Payload, &revocation); err != nil || revocation.UserId == "" {
+		fmt.Println("Ignoring malformed", event.EventType, "event")
+		return true
+	}
+	if event.EventType == userBannedEvent {
+		revocation.Banned = true
+		revocation.TokenHash = ""
+	}
+
+	revokeLocal(revocation)
+	cluster.relayAdminAction("", adminActionRevoke, revocation)
+	return true
+}
+
+// revokeLocal evicts the revoked tokens from this node's cache and closes the
+// sockets that authenticated with them.
+func revokeLocal(revocation RevocationPayload) {
+	matches := func(userId, token string) bool {
+		if userId != revocation.UserId {
+			return false
+		}
+		return revocation.TokenHash == "" || hashToken(token) == revocation.TokenHash
+	}
+
+	authenticator.evict(matches)
+
+	code, reason := closeSessionRevoked, "session revoked"
+	if revocation.Banned {
+		code, reason = closeUserBanned, "banned"
+	}
+	closed := closeTokenSockets(matches, code, reason)
+	if closed > 0 {
+		fmt.Printf("Closed %d connections of user %s: %s\n", closed, revocation.UserId, reason)
+	}
+}
+
+// closeTokenSockets closes every hub and voice socket whose user and token
+// match, dropping hub sessions so they cannot be resumed.
+func closeTokenSockets(matches func(userId, token string) bool, code int, reason string) int {
+	hub.lock.RLock()
+	var hubConns []*WSConnection
+	for userId, conns := range hub.clients {
+		for _, ws := range conns {
+			if matches(userId, ws.token) {
+				hubConns = append(hubConns, ws)
+			}
+		}
+	}
+	hub.lock.RUnlock()
+
+	vcHub.mu.RLock()
+	var voiceClients []*VcClient
+	for userId, client := range vcHub.clients {
+		if matches(userId, client.token) {
+			voiceClients = append(voiceClients, client)
+		}
+	}
+	vcHub.mu.RUnlock()
+
+	for _, ws := range hubConns {
+		session := ws.session()
+		ws.closeWithCode(code, reason)
+		if session != nil {
+			sessions.remove(session)
+		}
+	}
+	closing := websocket.FormatCloseMessage(code, reason)
+	for _, client := range voiceClients {
+		_ = client.Conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(pingTimeout))
+		client.Conn.Close()
+	}
+	return len(hubConns) + len(voiceClients)
+}
+
+func startTokenRevalidation() {
+	go func() {
+		ticker := time.NewTicker(cfg.TokenRevalidateInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			revalidateTokens()
+		}
+	}()
+}
+
+// revalidateTokens checks every token with an open socket on this node once.
+// Only a rejection from the API closes sockets; if the API cannot be reached
+// everyone stays connected and the round ends early.
+func revalidateTokens() {
+	owners := make(map[string]string)
+	hub.lock.RLock()
+	for userId, conns := range hub.clients {
+		for _, ws := range conns {
+			owners[ws.token] = userId
+		}
+	}
+	hub.lock.RUnlock()
+	vcHub.mu.RLock()
+	for userId, client := range vcHub.clients {
+		owners[client.token] = userId
+	}
+	vcHub.mu.RUnlock()
+	delete(owners, "")
+
+	for token, userId := range owners {
+		if draining.Load() {
+			return
+		}
+		validUserId, err := authenticator.validate(token)
+		if errors.Is(err, errAuthUnavailable) {
+			logErr("Error re-validating sessions, retrying next round", err)
+			return
+		}
+		if err != nil && !errors.Is(err, errInvalidSession) {
+			logErr("Error re-validating session", err)
+			continue
+		}
+		if err == nil && validUserId == userId {
+			continue
+		}
+
+		authenticator.evict(func(_, cachedToken string) bool { return cachedToken == token })
+		closeTokenSockets(func(connUserId, connToken string) bool {
+			return connUserId == userId && connToken == token
+		}, closeSessionRevoked, "session expired")
+	}
+}
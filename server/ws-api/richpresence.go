@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+)
+
+// On top of the status enum a user can set a custom status (text and emoji)
+// and a list of rich-presence activities. Both are stored next to the chosen
+// status in presence:{userId} and travel in UserStatusResponse through
+// broadcastStatusUpdate. A chosen status, a custom status and an activity can
+// each carry an expiry; due expiries are kept in the presence_expiry sorted
+// set and applied by whichever node claims them first.
+
+const (
+	presenceExpiryKey = "presence_expiry"
+
+	presenceExpiryInterval = 5 * time.Second
+
+	maxCustomStatusText  = 128
+	maxCustomStatusEmoji = 64
+	maxActivities        = 5
+	maxActivityField     = 128
+
+	ActivityPlaying   = "playing"
+	ActivityListening = "listening"
+	ActivityWatching  = "watching"
+
+	activitySourceYouTube = "youtube"
+	activitySourceSpotify = "spotify"
+)
+
+var trackIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type CustomStatus struct {
+	Text      string `json:"text,omitempty"`
+	Emoji     string `json:"emoji,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
+
+// Activity is what the user is doing. Listening activities may point at a
+// track played through the media-api streams with source and trackId, in
+// which case the server fills in the public URL.
+type Activity struct {
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Details   string `json:"details,omitempty"`
+	State     string `json:"state,omitempty"`
+	Source    string `json:"source,omitempty"`
+	TrackId   string `json:"trackId,omitempty"`
+	URL       string `json:"url,omitempty"`
+	StartedAt int64  `json:"startedAt,omitempty"`
+	EndsAt    int64  `json:"endsAt,omitempty"`
+}
+
+type SetActivitiesPayload struct {
+	Activities []Activity `json:"activities"`
+}
+
+func (s CustomStatus) validate(now int64) error {
+	if utf8.RuneCountInString(s.Text) > maxCustomStatusText {
+		return fmt.Errorf("custom status text is longer than %d characters", maxCustomStatusText)
+	}
+	if utf8.RuneCountInString(s.Emoji) > maxCustomStatusEmoji {
+		return fmt.Errorf("custom status emoji is longer than %d characters", maxCustomStatusEmoji)
+	}
+	if s.ExpiresAt != 0 && s.ExpiresAt <= now {
+		return fmt.Errorf("custom status expiry is in the past")
+	}
+	return nil
+}
+
+func (a *Activity) normalize(now int64) error {
+	switch a.Type {
+	case ActivityPlaying, ActivityListening, ActivityWatching:
+	default:
+		return fmt.Errorf("unknown activity type %q", a.Type)
+	}
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Name == "" {
+		return fmt.Errorf("activity name is required")
+	}
+	for _, field := range []string{a.Name, a.Details, a.State} {
+		if utf8.RuneCountInString(field) > maxActivityField {
+			return fmt.Errorf("activity field is longer than %d characters", maxActivityField)
+		}
+	}
+	if a.EndsAt != 0 && a.EndsAt <= now {
+		return fmt.Errorf("activity has already ended")
+	}
+
+	// URLs are only ever built here, never taken from the client.
+	a.URL = ""
+	switch a.Source {
+	case "":
+		a.TrackId = ""
+	case activitySourceYouTube, activitySourceSpotify:
+		if a.Type != ActivityListening || !trackIdPattern.MatchString(a.TrackId) {
+			return fmt.Errorf("invalid %s track", a.Source)
+		}
+		if a.Source == activitySourceYouTube {
+			a.URL = "https://www.youtube.com/watch?v=" + a.TrackId
+		} else {
+			a.URL = "https://open.spotify.com/track/" + a.TrackId
+		}
+	default:
+		return fmt.Errorf("unknown activity source %q", a.Source)
+	}
+	if a.StartedAt == 0 {
+		a.StartedAt = now
+	}
+	return nil
+}
+
+// decodePresenceDetails reads the customStatus and activities fields of a
+// presence hash.
+func decodePresenceDetails(customStatus, activities interface{}) (*CustomStatus, []Activity) {
+	var custom *CustomStatus
+	if raw, ok := customStatus.(string); ok && raw != "" {
+		var value CustomStatus
+		if json.Unmarshal([]byte(raw), &value) == nil {
+			custom = &value
+		}
+	}
+	var list []Activity
+	if raw, ok := activities.(string); ok && raw != "" {
+		_ = json.Unmarshal([]byte(raw), &list)
+	}
+	return custom, list
+}
+
+// describe builds the presence of a user as others see it with the given
+// status. Offline users carry no custom status, activities or clientStatus.
+func (presenceStore) describe(userId string, status UserStatus) UserStatusResponse {
+	response := UserStatusResponse{UserId: userId, Status: status}
+	if status == StatusOffline {
+		return response
+	}
+	pipe := redisClient.Pipeline()
+	fields := pipe.HMGet(ctx, presencePrefix+userId, "customStatus", "activities")
+	nodeDevices := pipe.HVals(ctx, presenceDevicesPrefix+userId)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		logErr("Error reading rich presence", err)
+		return response
+	}
+	if values := fields.Val(); len(values) == 2 {
+		response.CustomStatus, response.Activities = decodePresenceDetails(values[0], values[1])
+	}
+	response.ClientStatus = clientStatuses(nodeDevices.Val(), status, time.Now())
+	return response
+}
+
+func (presenceStore) setCustomStatus(userId string, status CustomStatus) error {
+	pipe := redisClient.TxPipeline()
+	if status.Text == "" && status.Emoji == "" {
+		pipe.HDel(ctx, presencePrefix+userId, "customStatus")
+		pipe.ZRem(ctx, presenceExpiryKey, "custom:"+userId)
+	} else {
+		pipe.HSet(ctx, presencePrefix+userId, "customStatus", []byte(mustJSON(status)))
+		scheduleExpiry(pipe, "custom:"+userId, status.ExpiresAt)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (presenceStore) setActivities(userId string, activities []Activity) error {
+	pipe := redisClient.TxPipeline()
+	if len(activities) == 0 {
+		pipe.HDel(ctx, presencePrefix+userId, "activities")
+		pipe.ZRem(ctx, presenceExpiryKey, "activities:"+userId)
+	} else {
+		var next int64
+		for _, a := range activities {
+			if a.EndsAt != 0 && (next == 0 || a.EndsAt < next) {
+				next = a.EndsAt
+			}
+		}
+		pipe.HSet(ctx, presencePrefix+userId, "activities", []byte(mustJSON(activities)))
+		scheduleExpiry(pipe, "activities:"+userId, next)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// clearActivities drops a user's activities once they are fully offline.
+func (presenceStore) clearActivities(userId string) {
+	pipe := redisClient.TxPipeline()
+	pipe.HDel(ctx, presencePrefix+userId, "activities")
+	pipe.ZRem(ctx, presenceExpiryKey, "activities:"+userId)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error clearing activities", err)
+	}
+}
+
+func scheduleExpiry(pipe redis.Pipeliner, member string, expiresAt int64) {
+	if expiresAt == 0 {
+		pipe.ZRem(ctx, presenceExpiryKey, member)
+		return
+	}
+	pipe.ZAdd(ctx, presenceExpiryKey, &redis.Z{Score: float64(expiresAt), Member: member})
+}
+
+func handleSetCustomStatus(conn *websocket.Conn, event EventMessage, userId string) {
+	var status CustomStatus
+	if err := unmarshalPayload(event, &status); err != nil {
+		rejectEvent(conn, userId, event, errorInvalidPayload, err)
+		return
+	}
+	status.Text = strings.TrimSpace(status.Text)
+	status.Emoji = strings.TrimSpace(status.Emoji)
+	if err := status.validate(time.Now().UnixMilli()); err != nil {
+		rejectEvent(conn, userId, event, errorInvalidValue, err)
+		return
+	}
+
+	if err := presence.setCustomStatus(userId, status); err != nil {
+		logErr("Error saving custom status", err)
+		return
+	}
+	broadcastPresenceChange(userId)
+}
+
+func handleSetActivities(conn *websocket.Conn, event EventMessage, userId string) {
+	var payload SetActivitiesPayload
+	if err := unmarshalPayload(event, &payload); err != nil {
+		rejectEvent(conn, userId, event, errorInvalidPayload, err)
+		return
+	}
+	if len(payload.Activities) > maxActivities {
+		rejectEvent(conn, userId, event, errorLimitExceeded, invalidField("activities", "at most %d activities are allowed", maxActivities))
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	for i := range payload.Activities {
+		if err := payload.Activities[i].normalize(now); err != nil {
+			rejectEvent(conn, userId, event, errorInvalidValue, err)
+			return
+		}
+	}
+
+	if err := presence.setActivities(userId, payload.Activities); err != nil {
+		logErr("Error saving activities", err)
+		return
+	}
+	broadcastPresenceChange(userId)
+}
+
+// broadcastPresenceChange announces a presence change to all of the user's
+// sessions, with the status they chose, and to their peers, with the status
+// they are allowed to see.
+func broadcastPresenceChange(userId string) {
+	visible := presence.effectiveStatuses([]string{userId})[userId]
+	own := visible
+	if presence.chosenStatus(userId) == StatusInvisible {
+		own = presence.describe(userId, StatusInvisible)
+	} else if visible.Status != StatusOffline {
+		broadcastStatusResponse(visible)
+	}
+	deliverToUsers("UPDATE_USER_STATUS", own, []string{userId})
+}
+
+// applyPresenceExpiry handles one due entry of presence_expiry. The entry is
+// re-read after it was claimed in case the user replaced it in the meantime.
+func applyPresenceExpiry(member string, now int64) {
+	kind, userId, ok := strings.Cut(member, ":")
+	if !ok {
+		return
+	}
+
+	switch kind {
+	case "status":
+		expiresAt, _ := redisClient.HGet(ctx, presencePrefix+userId, "statusExpiresAt").Int64()
+		if expiresAt == 0 {
+			return
+		}
+		if expiresAt > now {
+			rescheduleExpiry(member, expiresAt)
+			return
+		}
+		if err := presence.setChosenStatus(userId, StatusOnline, 0); err != nil {
+			logErr("Error expiring status", err)
+			return
+		}
+		activity.reset(userId)
+
+	case "custom":
+		fields, err := redisClient.HMGet(ctx, presencePrefix+userId, "customStatus", "activities").Result()
+		if err != nil {
+			return
+		}
+		custom, _ := decodePresenceDetails(fields[0], fields[1])
+		if custom == nil || custom.ExpiresAt == 0 {
+			return
+		}
+		if custom.ExpiresAt > now {
+			rescheduleExpiry(member, custom.ExpiresAt)
+			return
+		}
+		if err := presence.setCustomStatus(userId, CustomStatus{}); err != nil {
+			logErr("Error expiring custom status", err)
+			return
+		}
+
+	case "activities":
+		fields, err := redisClient.HMGet(ctx, presencePrefix+userId, "customStatus", "activities").Result()
+		if err != nil {
+			return
+		}
+		_, activities := decodePresenceDetails(fields[0], fields[1])
+		remaining := activities[:0]
+		for _, a := range activities {
+			if a.EndsAt == 0 || a.EndsAt > now {
+				remaining = append(remaining, a)
+			}
+		}
+		if len(remaining) == len(activities) {
+			_ = presence.setActivities(userId, activities)
+			return
+		}
+		if err := presence.setActivities(userId, remaining); err != nil {
+			logErr("Error expiring activities", err)
+			return
+		}
+
+	default:
+		return
+	}
+
+	broadcastPresenceChange(userId)
+}
+
+func rescheduleExpiry(member string, expiresAt int64) {
+	redisClient.ZAdd(ctx, presenceExpiryKey, &redis.Z{Score: float64(expiresAt), Member: member})
+}
+
+// startPresenceExpiry polls presence_expiry for due entries. ZREM decides
+// which node applies an entry, so each expiry is broadcast once.
+func startPresenceExpiry() {
+	ticker := time.NewTicker(presenceExpiryInterval)
+	go func() {
+		for range ticker.C {
+			now := time.Now().UnixMilli()
+			due, err := redisClient.ZRangeByScore(ctx, presenceExpiryKey, &redis.ZRangeBy{
+				Min:   "-inf",
+				Max:   strconv.FormatInt(now, 10),
+				Count: 100,
+			}).Result()
+			if err != nil {
+				logErr("Error reading presence expiries", err)
+				continue
+			}
+			for _, member := range due {
+				if removed, err := redisClient.ZRem(ctx, presenceExpiryKey, member).Result(); err != nil || removed == 0 {
+					continue
+				}
+				applyPresenceExpiry(member, now)
+			}
+		}
+	}()
+}
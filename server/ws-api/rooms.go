@@ -23,7 +23,7 @@ func notifyUserConnect(c *VcClient) {
 		if id == c.ID {
 			continue
 		}
-		sendJSON(other.Conn, Envelope{Event: "userConnect", Data: mustJSON(UserConnect{SID: c.ID})})
+		sendEnvelope(other, "userConnect", UserConnect{SID: c.ID})
 	}
 }
 
@@ -46,7 +46,7 @@ func cleanupClient(c *VcClient) {
 		}
 		for id, other := range vcHub.rooms[c.RoomID] {
 			_ = id
-			sendJSON(other.Conn, Envelope{Event: "userDisconnect", Data: mustJSON(UserDisconnect{SID: c.ID})})
+			sendEnvelope(other, "userDisconnect", UserDisconnect{SID: c.ID})
 		}
 		if len(vcHub.rooms[c.RoomID]) == 0 {
 			delete(vcHub.rooms, c.RoomID)
@@ -76,9 +76,7 @@ func notifyUserLeave(client *VcClient, roomID string) {
 		if c.ID == client.ID {
 			continue
 		}
-		select {
-		case c.Send <- msg:
-		default:
+		if !c.queue(msg) {
 			log.Println("[WS] Failed to notify userDisconnect to", c.ID)
 		}
 	}
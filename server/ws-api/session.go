@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Gateway sessions outlive the socket they were created on. Every frame sent
+// to a session is stamped with a sequence number and kept in a bounded replay
+// buffer, so a client that drops can reconnect, send RESUME and receive what
+// it missed while it was away.
+//
+// Sessions only exist in the memory of the node that created them. In cluster
+// mode the load balancer has to send a client's reconnects back to that node
+// (sticky sessions); a RESUME arriving anywhere else is answered with
+// INVALID_SESSION and the client starts over.
+
+var errSessionDetached = errors.New("session has no live connection")
+
+type replayFrame struct {
+	seq  uint64
+	data []byte
+}
+
+type GatewaySession struct {
+	ID     string
+	UserID string
+
+	mu          sync.Mutex
+	seq         uint64
+	buffer      []replayFrame
+	conn        *WSConnection
+	expiryTimer *time.Timer
+
+	subscriptions subscriptionSet
+}
+
+type OutboundEvent struct {
+	EventType string      `json:"event_type"`
+	Payload   interface{} `json:"payload"`
+	Seq       uint64      `json:"seq"`
+}
+
+type ResumePayload struct {
+	SessionID string `json:"sessionId"`
+	LastSeq   uint64 `json:"lastSeq"`
+}
+
+type SessionReadyResponse struct {
+	SessionID string `json:"sessionId"`
+	UserID    string `json:"userId"`
+}
+
+type InvalidSessionResponse struct {
+	SessionID string `json:"sessionId"`
+	Reload    bool   `json:"reload"`
+}
+
+type sessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*GatewaySession
+	byUser   map[string]map[string]*GatewaySession
+}
+
+var sessions = &sessionRegistry{
+	sessions: make(map[string]*GatewaySession),
+	byUser:   make(map[string]map[string]*GatewaySession),
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (r *sessionRegistry) create(userId string, ws *WSConnection) *GatewaySession {
+	s := &GatewaySession{
+		ID:     newSessionID(),
+		UserID: userId,
+		conn:   ws,
+	}
+
+	r.mu.Lock()
+	r.sessions[s.ID] = s
+	if r.byUser[userId] == nil {
+		r.byUser[userId] = make(map[string]*GatewaySession)
+	}
+	r.byUser[userId][s.ID] = s
+	r.mu.Unlock()
+
+	ws.setSession(s)
+	return s
+}
+
+func (r *sessionRegistry) get(sessionId string) (*GatewaySession, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[sessionId]
+	return s, ok
+}
+
+func (r *sessionRegistry) remove(s *GatewaySession) {
+	r.mu.Lock()
+	delete(r.sessions, s.ID)
+	lastSession := false
+	if userSessions, ok := r.byUser[s.UserID]; ok {
+		delete(userSessions, s.ID)
+		if len(userSessions) == 0 {
+			delete(r.byUser, s.UserID)
+			lastSession = true
+		}
+	}
+	r.mu.Unlock()
+
+	cluster.unregisterSession(s.UserID, s.ID, lastSession)
+}
+
+// detachedForUser returns the user's sessions that are waiting to be resumed.
+func (r *sessionRegistry) detachedForUser(userId string) []*GatewaySession {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var detached []*GatewaySession
+	for _, s := range r.byUser[userId] {
+		if s.isDetached() {
+			detached = append(detached, s)
+		}
+	}
+	return detached
+}
+
+func (s *GatewaySession) isDetached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn == nil
+}
+
+// send stamps the event with the next sequence number, records it for replay
+// and queues it on the live connection if there is one. Holding the session
+// lock across the enqueue keeps frames on the wire in sequence order.
+func (s *GatewaySession) send(eventType string, payload interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	frame, err := json.Marshal(OutboundEvent{
+		EventType: eventType,
+		Payload:   payload,
+		Seq:       s.seq,
+	})
+	if err != nil {
+		s.seq--
+		return err
+	}
+
+	s.buffer = append(s.buffer, replayFrame{seq: s.seq, data: frame})
+	if len(s.buffer) > cfg.ReplayBufferSize {
+		s.buffer = s.buffer[len(s.buffer)-cfg.ReplayBufferSize:]
+	}
+
+	if s.conn == nil {
+		return errSessionDetached
+	}
+	return s.conn.enqueue(frame)
+}
+
+// detach unbinds the session from its socket and keeps it around for the
+// resume window before it is dropped for good.
+func (s *GatewaySession) detach(ws *WSConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != ws {
+		return
+	}
+	s.conn = nil
+
+	if s.expiryTimer != nil {
+		s.expiryTimer.Stop()
+	}
+	s.expiryTimer = time.AfterFunc(cfg.SessionResumeWindow, func() {
+		if s.isDetached() {
+			sessions.remove(s)
+		}
+	})
+}
+
+// resume binds the session to ws and replays every buffered frame after
+// lastSeq. It returns false when the frames the client is missing have
+// already been trimmed from the buffer.
+func (s *GatewaySession) resume(ws *WSConnection, lastSeq uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lastSeq > s.seq {
+		return false
+	}
+	if lastSeq < s.seq && (len(s.buffer) == 0 || s.buffer[0].seq > lastSeq+1) {
+		return false
+	}
+
+	if s.expiryTimer != nil {
+		s.expiryTimer.Stop()
+		s.expiryTimer = nil
+	}
+
+	previous := s.conn
+	s.conn = ws
+
+	if previous != nil && previous != ws {
+		previous.Conn.Close()
+	}
+
+	ws.setSession(s)
+	for _, f := range s.buffer {
+		if f.seq <= lastSeq {
+			continue
+		}
+		if err := ws.enqueue(f.data); err != nil {
+			return true
+		}
+	}
+	return true
+}
+
+func (ws *WSConnection) session() *GatewaySession {
+	ws.Mutex.Lock()
+	defer ws.Mutex.Unlock()
+	return ws.Session
+}
+
+func (ws *WSConnection) setSession(s *GatewaySession) {
+	ws.Mutex.Lock()
+	defer ws.Mutex.Unlock()
+	ws.Session = s
+}
+
+// handleResume moves a session onto the connection that asked for it. Only
+// sessions held by this node can be resumed, see the note at the top.
+func handleResume(conn *websocket.Conn, event EventMessage, userId string) {
+	var request ResumePayload
+	if err := unmarshalPayload(event, &request); err != nil || request.SessionID == "" {
+		return
+	}
+
+	ws := findConnection(userId, conn)
+	if ws == nil {
+		return
+	}
+
+	target, ok := sessions.get(request.SessionID)
+	if !ok || target.UserID != userId {
+		writeToConn(ws, "INVALID_SESSION", InvalidSessionResponse{SessionID: request.SessionID, Reload: true})
+		return
+	}
+
+	fresh := ws.session()
+	if fresh == target {
+		return
+	}
+
+	if !target.resume(ws, request.LastSeq) {
+		writeToConn(ws, "INVALID_SESSION", InvalidSessionResponse{SessionID: request.SessionID, Reload: true})
+		return
+	}
+
+	if fresh != nil {
+		sessions.remove(fresh)
+	}
+
+	writeToConn(ws, "RESUMED", SessionReadyResponse{SessionID: target.ID, UserID: userId})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// On SIGTERM the gateway drains instead of dropping everyone at once:
+//
+//  1. new /ws and /video-ws upgrades are refused with 503
+//  2. every hub and voice client gets RECONNECT with a jittered delay, so the
+//     reconnects of a whole node do not land on the survivors in one burst
+//  3. the stream consumer finishes and acks its current batch and stops
+//  4. sockets are closed with 1012 (service restart)
+//  5. this node's presence is released and users not connected elsewhere are
+//     announced offline
+//  6. the HTTP server shuts down
+//
+// All of it has to fit in ShutdownTimeout.
+
+const (
+	reconnectEvent    = "RECONNECT"
+	queueDrainTimeout = time.Second
+	queueDrainPoll    = 50 * time.Millisecond
+)
+
+type ReconnectResponse struct {
+	Reason  string `json:"reason"`
+	DelayMs int64  `json:"delayMs"`
+}
+
+var draining atomic.Bool
+
+// rejectWhileDraining keeps new clients off a node that is shutting down; the
+// load balancer or the client's retry sends them elsewhere.
+func rejectWhileDraining() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if draining.Load() {
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func reconnectDelay() int64 {
+	if cfg.ShutdownReconnectJitter <= 0 {
+		return 0
+	}
+	return rand.Int63n(cfg.ShutdownReconnectJitter.Milliseconds())
+}
+
+func shutdownGateway(srv *http.Server) {
+	deadline, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	fmt.Println("Shutting down, draining connections")
+	draining.Store(true)
+
+	userIds, hubConns, voiceClients := drainTargets()
+	for _, ws := range hubConns {
+		writeToConn(ws, reconnectEvent, ReconnectResponse{Reason: "server restart", DelayMs: reconnectDelay()})
+	}
+	for _, client := range voiceClients {
+		sendEnvelope(client, reconnectEvent, ReconnectResponse{Reason: "server restart", DelayMs: reconnectDelay()})
+	}
+
+	stopStreamConsumer(deadline)
+	waitForQueues(deadline, hubConns, voiceClients)
+
+	for _, ws := range hubConns {
+		ws.closeWithCode(websocket.CloseServiceRestart, "server restart")
+	}
+	closing := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restart")
+	for _, client := range voiceClients {
+		_ = client.Conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(pingTimeout))
+		client.Conn.Close()
+	}
+
+	releasePresence(userIds)
+
+	if err := srv.Shutdown(deadline); err != nil {
+		logErr("Error shutting down HTTP server", err)
+	}
+	fmt.Printf("Shutdown complete, closed %d gateway and %d voice connections\n", len(hubConns), len(voiceClients))
+}
+
+func drainTargets() ([]string, []*WSConnection, []*VcClient) {
+	hub.lock.RLock()
+	userIds := make([]string, 0, len(hub.clients))
+	var hubConns []*WSConnection
+	for userId, conns := range hub.clients {
+		userIds = append(userIds, userId)
+		hubConns = append(hubConns, conns...)
+	}
+	hub.lock.RUnlock()
+
+	vcHub.mu.RLock()
+	voiceClients := make([]*VcClient, 0, len(vcHub.clients))
+	for _, client := range vcHub.clients {
+		voiceClients = append(voiceClients, client)
+	}
+	vcHub.mu.RUnlock()
+	return userIds, hubConns, voiceClients
+}
+
+// waitForQueues gives the writers a moment to get RECONNECT and anything
+// queued before it onto the wire.
+func waitForQueues(deadline context.Context, hubConns []*WSConnection, voiceClients []*VcClient) {
+	timeout := time.After(queueDrainTimeout)
+	for {
+		pending := false
+		for _, ws := range hubConns {
+			if len(ws.Send) > 0 {
+				pending = true
+				break
+			}
+		}
+		for _, client := range voiceClients {
+			if len(client.Send) > 0 {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			return
+		}
+
+		select {
+		case <-deadline.Done():
+			return
+		case <-timeout:
+			return
+		case <-time.After(queueDrainPoll):
+		}
+	}
+}
+
+// releasePresence settles presence before the process exits. This node's
+// liveness entries are removed, and every drained user, as well as anyone who
+// left earlier and was still waiting for their offline broadcast, is announced
+// offline unless another node holds a live connection for them. Users who
+// already reconnected elsewhere are left alone; the rest come back online when
+// they do. In cluster mode the node also drops its registrations itself rather
+// than waiting for the survivors to notice its heartbeat is gone.
+func releasePresence(userIds []string) {
+	offline := make(map[string]struct{}, len(userIds))
+	for _, userId := range userIds {
+		offline[userId] = struct{}{}
+	}
+
+	disconnectTimers.Lock()
+	for userId, timer := range disconnectTimers.timers {
+		if timer.Stop() {
+			offline[userId] = struct{}{}
+		}
+		delete(disconnectTimers.timers, userId)
+	}
+	disconnectTimers.Unlock()
+
+	if cluster.enabled {
+		cluster.reapNode(cluster.nodeID)
+	}
+	for userId := range offline {
+		announceOffline(userId)
+	}
+}
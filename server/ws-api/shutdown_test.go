@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func offlineAnnouncements(t *testing.T, f *fakeRedis) []string {
+	t.Helper()
+	var userIds []string
+	for _, raw := range f.messages(presenceUpdatesChannel) {
+		var response UserStatusResponse
+		if err := json.Unmarshal([]byte(raw), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Status == StatusOffline {
+			userIds = append(userIds, response.UserId)
+		}
+	}
+	sort.Strings(userIds)
+	return userIds
+}
+
+func TestReleasePresenceAnnouncesDrainedUsers(t *testing.T) {
+	f := startFakeRedis(t)
+	previous := cfg
+	t.Cleanup(func() { cfg = previous })
+	cfg.NodeID = "node-a"
+	cfg.PresenceTTL = 90 * time.Second
+
+	now := time.Now().Unix()
+	redisClient.HSet(ctx, presenceLivePrefix+"alone", "node-a", now)
+	redisClient.HSet(ctx, presenceLivePrefix+"elsewhere", "node-a", now, "node-b", now)
+	redisClient.HSet(ctx, presenceLivePrefix+"hidden", "node-a", now)
+	redisClient.HSet(ctx, presencePrefix+"hidden", "status", string(StatusInvisible))
+	redisClient.HSet(ctx, presenceLivePrefix+"left", "node-a", now)
+
+	disconnectTimers.Lock()
+	disconnectTimers.timers["left"] = time.AfterFunc(time.Hour, func() {})
+	disconnectTimers.Unlock()
+
+	releasePresence([]string{"alone", "elsewhere", "hidden"})
+
+	if got, want := offlineAnnouncements(t, f), []string{"alone", "left"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("announced offline %v, want %v", got, want)
+	}
+	for _, userId := range []string{"alone", "elsewhere", "hidden", "left"} {
+		if redisClient.HExists(ctx, presenceLivePrefix+userId, "node-a").Val() {
+			t.Errorf("%s: node-a still marked live", userId)
+		}
+	}
+	disconnectTimers.Lock()
+	pending := len(disconnectTimers.timers)
+	disconnectTimers.Unlock()
+	if pending != 0 {
+		t.Errorf("%d disconnect timers left", pending)
+	}
+}
+
+func TestReleasePresenceDropsClusterRegistrations(t *testing.T) {
+	f := startFakeRedis(t)
+	previous, previousCluster := cfg, *cluster
+	t.Cleanup(func() {
+		cfg = previous
+		*cluster = previousCluster
+	})
+	cfg.NodeID = "node-a"
+	cfg.PresenceTTL = 90 * time.Second
+	cluster.enabled = true
+	cluster.nodeID = "node-a"
+
+	now := time.Now().Unix()
+	redisClient.SAdd(ctx, clusterNodesKey, "node-a", "node-b")
+	redisClient.Set(ctx, clusterNodeAlivePrefix+"node-a", now, 0)
+	redisClient.SAdd(ctx, clusterNodeUsersPrefix+"node-a", "alone", "moved")
+	redisClient.SAdd(ctx, clusterUserNodesPrefix+"alone", "node-a")
+	redisClient.SAdd(ctx, clusterUserNodesPrefix+"moved", "node-a", "node-b")
+	redisClient.HSet(ctx, presenceLivePrefix+"alone", "node-a", now)
+	redisClient.HSet(ctx, presenceLivePrefix+"moved", "node-a", now, "node-b", now)
+
+	releasePresence([]string{"alone", "moved"})
+
+	if got, want := offlineAnnouncements(t, f), []string{"alone"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("announced offline %v, want %v", got, want)
+	}
+	if redisClient.Exists(ctx, clusterNodeAlivePrefix+"node-a", clusterNodeUsersPrefix+"node-a").Val() != 0 {
+		t.Error("node registrations left behind")
+	}
+	if redisClient.SIsMember(ctx, clusterNodesKey, "node-a").Val() {
+		t.Error("node still listed in the cluster")
+	}
+	if got := redisClient.SMembers(ctx, clusterUserNodesPrefix+"moved").Val(); !reflect.DeepEqual(got, []string{"node-b"}) {
+		t.Errorf("moved user registered on %v, want [node-b]", got)
+	}
+}
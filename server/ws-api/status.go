@@ -2,12 +2,17 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // This file handles user status updates and retrievals in a WebSocket server.
 
+// maxStatusQueryIds bounds GET_USER_STATUS, since every id costs several
+// Redis lookups.
+const maxStatusQueryIds = 100
+
 const (
 	StatusOnline    UserStatus = "online"
 	StatusIdle      UserStatus = "idle"
@@ -16,6 +21,15 @@ const (
 	StatusInvisible UserStatus = "invisible"
 )
 
+type UpdateUserStatusPayload struct {
+	Status    string `json:"status"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+}
+
+type GetUserStatusPayload struct {
+	UserIds []string `json:"user_ids"`
+}
+
 func isValidStatus(status UserStatus) bool {
 	switch status {
 	case StatusOnline, StatusIdle, StatusDND, StatusInvisible, StatusOffline:
@@ -25,68 +39,52 @@ func isValidStatus(status UserStatus) bool {
 }
 
 func handleUpdateUserStatus(conn *websocket.Conn, event EventMessage, userId string) {
-	var statusUpdate struct {
-		Status string `json:"status"`
-	}
+	var statusUpdate UpdateUserStatusPayload
 	if err := unmarshalPayload(event, &statusUpdate); err != nil {
-		fmt.Println("Error unmarshalling status update:", err)
+		rejectEvent(conn, userId, event, errorInvalidPayload, err)
 		return
 	}
 
 	status := UserStatus(statusUpdate.Status)
-	if isValidStatus(status) {
-		hub.lock.Lock()
-		hub.status[userId] = status
-		hub.lock.Unlock()
-
-		broadcastStatusUpdate(userId, status)
+	if statusUpdate.ExpiresAt != 0 && statusUpdate.ExpiresAt <= time.Now().UnixMilli() {
+		rejectEvent(conn, userId, event, errorInvalidValue, invalidField("expiresAt", "expiresAt is in the past"))
+		return
+	}
+	if !isValidStatus(status) {
+		rejectEvent(conn, userId, event, errorInvalidValue, invalidField("status", "unknown status %q", statusUpdate.Status))
+		return
+	}
 
-		fmt.Printf("User %s status updated to %s\n", userId, status)
-	} else {
-		fmt.Println("Invalid status:", statusUpdate.Status)
+	if err := presence.setChosenStatus(userId, status, statusUpdate.ExpiresAt); err != nil {
+		logErr("Error saving user status", err)
+		return
 	}
+	activity.reset(userId)
+
+	broadcastStatusUpdate(userId, visibleStatus(status))
+
+	fmt.Printf("User %s status updated to %s\n", userId, status)
 }
 
 func handleGetUserStatus(conn *websocket.Conn, event EventMessage, userId string) {
-	var request struct {
-		UserIds []string `json:"user_ids"`
-	}
+	var request GetUserStatusPayload
 	if err := unmarshalPayload(event, &request); err != nil {
-		fmt.Println("Error unmarshalling get status request:", err)
+		rejectEvent(conn, userId, event, errorInvalidPayload, err)
 		return
 	}
 
-	hub.lock.RLock()
+	if len(request.UserIds) > maxStatusQueryIds {
+		rejectEvent(conn, userId, event, errorLimitExceeded, invalidField("user_ids", "at most %d user ids are allowed", maxStatusQueryIds))
+		return
+	}
+
+	statuses := presence.effectiveStatuses(request.UserIds)
 	var statusResponses []UserStatusResponse
 	for _, id := range request.UserIds {
-		userStatus, exists := hub.status[id]
-		_, isConnected := hub.clients[id]
-
-		if !exists || !isConnected {
-			userStatus = StatusOffline
-		} else if userStatus == StatusInvisible {
-			userStatus = StatusOffline
-		}
-
-		statusResponses = append(statusResponses, UserStatusResponse{
-			UserId: id,
-			Status: userStatus,
-		})
-	}
-	var ws *WSConnection
-	for _, conns := range hub.clients {
-		for _, c := range conns {
-			if c.Conn == conn {
-				ws = c
-				break
-			}
-		}
-		if ws != nil {
-			break
-		}
+		statusResponses = append(statusResponses, statuses[id])
 	}
-	hub.lock.RUnlock()
 
+	ws := findConnection(userId, conn)
 	if ws == nil {
 		return
 	}
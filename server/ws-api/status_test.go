@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestGetUserStatusLimitsIds(t *testing.T) {
+	startFakeRedis(t)
+	server, _ := websocketPair(t)
+	ws := &WSConnection{Conn: server, Send: make(chan []byte, 1), done: make(chan struct{})}
+	hub.lock.Lock()
+	hub.clients["asking"] = []*WSConnection{ws}
+	hub.lock.Unlock()
+	t.Cleanup(func() {
+		hub.lock.Lock()
+		delete(hub.clients, "asking")
+		hub.lock.Unlock()
+	})
+
+	query := func(count int) (string, json.RawMessage) {
+		ids := make([]string, count)
+		for i := range ids {
+			ids[i] = "user-" + strconv.Itoa(i)
+		}
+		payload, _ := json.Marshal(GetUserStatusPayload{UserIds: ids})
+		handleGetUserStatus(server, EventMessage{EventType: "GET_USER_STATUS", Payload: payload}, "asking")
+		var frame struct {
+			EventType string          `json:"event_type"`
+			Payload   json.RawMessage `json:"payload"`
+		}
+		if err := json.Unmarshal(<-ws.Send, &frame); err != nil {
+			t.Fatal(err)
+		}
+		return frame.EventType, frame.Payload
+	}
+
+	eventType, payload := query(maxStatusQueryIds)
+	var statuses []UserStatusResponse
+	if eventType != "GET_USER_STATUS" || json.Unmarshal(payload, &statuses) != nil || len(statuses) != maxStatusQueryIds {
+		t.Fatalf("query at the limit answered %s %s", eventType, payload)
+	}
+
+	eventType, payload = query(maxStatusQueryIds + 1)
+	var gatewayErr GatewayError
+	if eventType != errorEvent || json.Unmarshal(payload, &gatewayErr) != nil {
+		t.Fatalf("oversized query answered %s %s", eventType, payload)
+	}
+	if gatewayErr.Code != errorLimitExceeded || gatewayErr.Field != "user_ids" {
+		t.Fatalf("oversized query rejected with %+v", gatewayErr)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clients send SUBSCRIBE with the guilds and channels they are looking at; a
+// listed guild counts as focusing all of its channels. Once a session has
+// subscribed, high-volume events for unfocused channels are
+// not delivered to it: typing and edits are dropped, and new messages are
+// replaced by a small MESSAGE_UNREAD marker so unread badges keep working.
+// Sessions that never subscribe keep receiving everything.
+
+type SubscribePayload struct {
+	GuildIDs   []string `json:"guildIds"`
+	ChannelIDs []string `json:"channelIds"`
+}
+
+type MessageUnreadResponse struct {
+	GuildID   string `json:"guildId"`
+	ChannelID string `json:"channelId"`
+	MessageID string `json:"messageId,omitempty"`
+	UserID    string `json:"userId,omitempty"`
+}
+
+type subscriptionSet struct {
+	mu       sync.RWMutex
+	active   bool
+	guilds   map[string]struct{}
+	channels map[string]struct{}
+}
+
+// eventScope describes where a filterable event happened, and for events
+// echoed to the user's own sessions, which session caused it.
+type eventScope struct {
+	filterable    bool
+	eventType     string
+	guildID       string
+	channelID     string
+	messageID     string
+	userID        string
+	originSession string
+}
+
+var filterableEvents = map[string]bool{
+	"START_TYPING":       true,
+	"STOP_TYPING":        true,
+	"EDIT_MESSAGE_GUILD": true,
+	"SEND_MESSAGE_GUILD": true,
+}
+
+// Events a session triggers itself and should not get back.
+var originSkippedEvents = map[string]bool{
+	messageAckEvent: true,
+}
+
+func scopeOf(eventType string, payload interface{}) eventScope {
+	if !filterableEvents[eventType] && !originSkippedEvents[eventType] {
+		return eventScope{}
+	}
+
+	raw, ok := payload.(json.RawMessage)
+	if !ok {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return eventScope{}
+		}
+		raw = b
+	}
+
+	var parsed struct {
+		GuildID   string `json:"guildId"`
+		ChannelID string `json:"channelId"`
+		MessageID string `json:"messageId"`
+		UserID    string `json:"userId"`
+		SessionID string `json:"sessionId"`
+		Messages  []struct {
+			MessageID string `json:"messageId"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		return eventScope{}
+	}
+	if originSkippedEvents[eventType] {
+		return eventScope{originSession: parsed.SessionID}
+	}
+	if parsed.ChannelID == "" {
+		return eventScope{}
+	}
+
+	scope := eventScope{
+		filterable: true,
+		eventType:  eventType,
+		guildID:    parsed.GuildID,
+		channelID:  parsed.ChannelID,
+		messageID:  parsed.MessageID,
+		userID:     parsed.UserID,
+	}
+	if scope.messageID == "" && len(parsed.Messages) > 0 {
+		scope.messageID = parsed.Messages[len(parsed.Messages)-1].MessageID
+	}
+	return scope
+}
+
+// unreadMarker returns the lightweight event that replaces a filtered one, if
+// the event should leave a trace at all.
+func (scope eventScope) unreadMarker() (string, interface{}, bool) {
+	if scope.eventType != "SEND_MESSAGE_GUILD" {
+		return "", nil, false
+	}
+	return "MESSAGE_UNREAD", MessageUnreadResponse{
+		GuildID:   scope.guildID,
+		ChannelID: scope.channelID,
+		MessageID: scope.messageID,
+		UserID:    scope.userID,
+	}, true
+}
+
+func (s *subscriptionSet) set(payload SubscribePayload) {
+	guilds := make(map[string]struct{}, len(payload.GuildIDs))
+	for _, id := range payload.GuildIDs {
+		guilds[id] = struct{}{}
+	}
+	channels := make(map[string]struct{}, len(payload.ChannelIDs))
+	for _, id := range payload.ChannelIDs {
+		channels[id] = struct{}{}
+	}
+
+	s.mu.Lock()
+	s.active = true
+	s.guilds = guilds
+	s.channels = channels
+	s.mu.Unlock()
+}
+
+// snapshot returns the focused guilds and channels, and false while the
+// session has not subscribed.
+func (s *subscriptionSet) snapshot() (SubscribePayload, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.active {
+		return SubscribePayload{}, false
+	}
+	payload := SubscribePayload{
+		GuildIDs:   make([]string, 0, len(s.guilds)),
+		ChannelIDs: make([]string, 0, len(s.channels)),
+	}
+	for id := range s.guilds {
+		payload.GuildIDs = append(payload.GuildIDs, id)
+	}
+	for id := range s.channels {
+		payload.ChannelIDs = append(payload.ChannelIDs, id)
+	}
+	return payload, true
+}
+
+// wants reports whether the full event should be delivered.
+func (s *subscriptionSet) wants(scope eventScope) bool {
+	if !scope.filterable {
+		return true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.active {
+		return true
+	}
+	if _, ok := s.channels[scope.channelID]; ok {
+		return true
+	}
+	_, ok := s.guilds[scope.guildID]
+	return ok && scope.guildID != ""
+}
+
+// deliver sends the event to the session, or its unread marker when the
+// session is not focused on the event's channel. Events the session caused
+// itself are skipped.
+func (s *GatewaySession) deliver(eventType string, payload interface{}, scope eventScope) error {
+	if scope.originSession != "" && scope.originSession == s.ID {
+		return nil
+	}
+	if s.subscriptions.wants(scope) {
+		return s.send(eventType, payload)
+	}
+	if markerType, marker, ok := scope.unreadMarker(); ok {
+		return s.send(markerType, marker)
+	}
+	return nil
+}
+
+func handleSubscribe(conn *websocket.Conn, event EventMessage, userId string) {
+	var payload SubscribePayload
+	if err := unmarshalPayload(event, &payload); err != nil {
+		return
+	}
+
+	ws := findConnection(userId, conn)
+	if ws == nil {
+		return
+	}
+	if session := ws.session(); session != nil {
+		session.subscriptions.set(payload)
+	}
+}
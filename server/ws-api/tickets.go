@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Sockets authenticate with a connection ticket instead of the session token,
+// so the token never shows up in URLs, proxy logs or subprotocol headers.
+// A client POSTs to /ws-ticket with its token in the Authorization header and
+// connects to /ws or /video-ws within ConnectionTicketTTL with ?ticket=... or
+// a "ticket-..." subprotocol. Tickets live in
+//
+//	ws_ticket:{sha256 of ticket}  storedTicket, expires after ConnectionTicketTTL
+//
+// and are deleted when redeemed, so each one opens a single socket on any
+// node. The token has to come back out of the ticket because the socket is
+// re-validated with it later (see revocation.go), so it is sealed with
+// AES-GCM under a key derived from the ticket: Redis holds neither the token
+// nor anything that redeems it. The old token query parameter and "cookie-"
+// subprotocol only work with AllowLegacyTokenAuth.
+
+const (
+	ticketPrefix         = "ws_ticket:"
+	ticketBytes          = 32
+	ticketSubprotocol    = "ticket-"
+	legacyCookieProtocol = "cookie-"
+)
+
+var (
+	errTicketMissing = errors.New("connection ticket required")
+	errTicketInvalid = errors.New("invalid or expired connection ticket")
+)
+
+type ConnectionTicket struct {
+	UserId string
+	Token  string
+}
+
+type storedTicket struct {
+	UserId      string `json:"userId"`
+	SealedToken []byte `json:"sealedToken"`
+}
+
+type TicketResponse struct {
+	Ticket    string `json:"ticket"`
+	ExpiresIn int    `json:"expiresIn"`
+}
+
+func handleIssueTicket(c *gin.Context) {
+	enableCORS(c.Writer, c.Request)
+	if c.Request.Method == http.MethodOptions {
+		c.Abort()
+		return
+	}
+
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") || token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"message": "session missing"})
+		return
+	}
+	userId, err := authenticator.authenticate(token)
+	if err != nil {
+		c.JSON(authStatus(err), gin.H{"message": err.Error()})
+		return
+	}
+
+	ticket, err := issueTicket(userId, token)
+	if err != nil {
+		logErr("Error storing connection ticket", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed to issue ticket"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, TicketResponse{Ticket: ticket, ExpiresIn: int(cfg.ConnectionTicketTTL.Seconds())})
+}
+
+// issueTicket stores a new ticket for the user's token and returns it.
+func issueTicket(userId, token string) (string, error) {
+	b := make([]byte, ticketBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(b)
+
+	aead, err := ticketCipher(ticket)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(userId))
+
+	stored := mustJSON(storedTicket{UserId: userId, SealedToken: sealed})
+	if err := redisClient.Set(ctx, ticketKey(ticket), []byte(stored), cfg.ConnectionTicketTTL).Err(); err != nil {
+		return "", err
+	}
+	return ticket, nil
+}
+
+// redeemTicket consumes a ticket. Reading and deleting it in one transaction
+// makes sure it opens at most one socket.
+func redeemTicket(ticket string) (ConnectionTicket, error) {
+	key := ticketKey(ticket)
+	pipe := redisClient.TxPipeline()
+	get := pipe.Get(ctx, key)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		if err == redis.Nil {
+			return ConnectionTicket{}, errTicketInvalid
+		}
+		return ConnectionTicket{}, err
+	}
+
+	var stored storedTicket
+	if err := json.Unmarshal([]byte(get.Val()), &stored); err != nil || stored.UserId == "" {
+		return ConnectionTicket{}, errTicketInvalid
+	}
+	aead, err := ticketCipher(ticket)
+	if err != nil {
+		return ConnectionTicket{}, err
+	}
+	if len(stored.SealedToken) < aead.NonceSize() {
+		return ConnectionTicket{}, errTicketInvalid
+	}
+	nonce, sealed := stored.SealedToken[:aead.NonceSize()], stored.SealedToken[aead.NonceSize():]
+	token, err := aead.Open(nil, nonce, sealed, []byte(stored.UserId))
+	if err != nil {
+		return ConnectionTicket{}, errTicketInvalid
+	}
+	return ConnectionTicket{UserId: stored.UserId, Token: string(token)}, nil
+}
+
+// ticketKey is where a ticket is stored. Only a hash of the ticket is used, so
+// the key cannot be redeemed by someone reading Redis.
+func ticketKey(ticket string) string {
+	sum := sha256.Sum256([]byte("ws-ticket-id:" + ticket))
+	return ticketPrefix + hex.EncodeToString(sum[:])
+}
+
+// ticketCipher returns the AES-GCM cipher that seals the token stored with a
+// ticket, keyed by the ticket itself.
+func ticketCipher(ticket string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("ws-ticket-key:" + ticket))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func offeredProtocol(r *http.Request, prefix string) string {
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			protocol = strings.TrimSpace(protocol)
+			if strings.HasPrefix(protocol, prefix) {
+				return protocol
+			}
+		}
+	}
+	return ""
+}
+
+// selectProtocol returns the upgrade header that answers with protocol. The
+// header is set with its canonical key, which is the one the upgrader reads.
+func selectProtocol(protocol string) http.Header {
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Protocol", protocol)
+	return header
+}
+
+// authenticateUpgrade resolves who is opening a socket. It returns the user,
+// the token the socket is bound to and the header to upgrade with, which
+// selects the subprotocol the client offered.
+func authenticateUpgrade(r *http.Request) (string, string, http.Header, error) {
+	var header http.Header
+	ticket := r.URL.Query().Get("ticket")
+	if protocol := offeredProtocol(r, ticketSubprotocol); protocol != "" {
+		ticket = strings.TrimPrefix(protocol, ticketSubprotocol)
+		header = selectProtocol(protocol)
+	}
+	if ticket != "" {
+		stored, err := redeemTicket(ticket)
+		if err != nil {
+			return "", "", nil, err
+		}
+		return stored.UserId, stored.Token, header, nil
+	}
+
+	if !cfg.AllowLegacyTokenAuth {
+		return "", "", nil, errTicketMissing
+	}
+	token := r.URL.Query().Get("token")
+	if protocol := offeredProtocol(r, legacyCookieProtocol); protocol != "" {
+		token = strings.TrimPrefix(protocol, legacyCookieProtocol)
+		header = selectProtocol(protocol)
+	}
+	if token == "" {
+		return "", "", nil, errors.New("session missing")
+	}
+	userId, err := authenticator.authenticate(token)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return userId, token, header, nil
+}
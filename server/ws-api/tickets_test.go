@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedeemTicketOnlyOnce(t *testing.T) {
+	startFakeRedis(t)
+
+	ticket, err := issueTicket("user", "session-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redeemed, err := redeemTicket(ticket)
+	if err != nil {
+		t.Fatalf("first redeem: %v", err)
+	}
+	if redeemed.UserId != "user" || redeemed.Token != "session-token" {
+		t.Fatalf("redeemed %+v", redeemed)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := redeemTicket(ticket); err != errTicketInvalid {
+			t.Fatalf("reuse %d: err = %v, want %v", i+1, err, errTicketInvalid)
+		}
+	}
+}
+
+func TestRedeemTicketRejectsUnknownAndTamperedTickets(t *testing.T) {
+	fake := startFakeRedis(t)
+
+	if _, err := redeemTicket("never-issued"); err != errTicketInvalid {
+		t.Fatalf("unknown ticket: err = %v", err)
+	}
+
+	ticket, err := issueTicket("user", "session-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	stored := fake.strings[ticketKey(ticket)]
+	fake.strings[ticketKey(ticket)] = strings.Replace(stored, `"userId":"user"`, `"userId":"someone-else"`, 1)
+	fake.mu.Unlock()
+	if _, err := redeemTicket(ticket); err != errTicketInvalid {
+		t.Fatalf("ticket moved to another user: err = %v", err)
+	}
+}
+
+func TestTicketKeepsTokenOutOfRedis(t *testing.T) {
+	fake := startFakeRedis(t)
+
+	ticket, err := issueTicket("user", "session-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.strings) != 1 {
+		t.Fatalf("%d keys stored, want 1", len(fake.strings))
+	}
+	for key, value := range fake.strings {
+		for _, secret := range []string{"session-token", ticket} {
+			if strings.Contains(key, secret) || strings.Contains(value, secret) {
+				t.Errorf("%q found in Redis entry %s = %s", secret, key, value)
+			}
+		}
+	}
+}
+
+func TestAuthenticateUpgradeWithTicket(t *testing.T) {
+	startFakeRedis(t)
+	previous := cfg
+	t.Cleanup(func() { cfg = previous })
+	cfg.AllowLegacyTokenAuth = false
+
+	byQuery, _ := issueTicket("user", "query-token")
+	r := httptest.NewRequest("GET", "/ws?ticket="+byQuery, nil)
+	userId, token, header, err := authenticateUpgrade(r)
+	if err != nil || userId != "user" || token != "query-token" || header != nil {
+		t.Fatalf("query ticket: %q %q %v %v", userId, token, header, err)
+	}
+
+	byProtocol, _ := issueTicket("user", "protocol-token")
+	r = httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Sec-WebSocket-Protocol", "json, "+ticketSubprotocol+byProtocol)
+	userId, token, header, err = authenticateUpgrade(r)
+	if err != nil || userId != "user" || token != "protocol-token" {
+		t.Fatalf("subprotocol ticket: %q %q %v", userId, token, err)
+	}
+	if got := header.Get("Sec-WebSocket-Protocol"); got != ticketSubprotocol+byProtocol {
+		t.Fatalf("upgrade selects subprotocol %q", got)
+	}
+
+	r = httptest.NewRequest("GET", "/ws?token=legacy", nil)
+	if _, _, _, err := authenticateUpgrade(r); err != errTicketMissing {
+		t.Fatalf("legacy token without AllowLegacyTokenAuth: err = %v", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/gorilla/websocket"
 )
@@ -23,6 +24,16 @@ type VcClient struct {
 	IsNoisy    bool
 	IsMuted    bool
 	IsDeafened bool
+
+	token        string
+	compressor   *frameCompressor
+	codec        *wireCodec
+	lastActivity atomic.Int64
+
+	// sendMu guards Send against being written to after cleanupConnection
+	// closed it; use queue and closeSend instead of touching Send directly.
+	sendMu     sync.Mutex
+	sendClosed bool
 }
 
 type VcHub struct {
@@ -77,6 +88,7 @@ func newHub() *VcHub {
 }
 func newWsUpgrader() websocket.Upgrader {
 	return websocket.Upgrader{
+		EnableCompression: true,
 		CheckOrigin: func(r *http.Request) bool {
 			origin := r.Header.Get("Origin")
 			if origin == "" {
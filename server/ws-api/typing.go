@@ -2,13 +2,38 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/websocket"
 )
 
+// Typing indicators are scoped to one channel. Guild typing goes to the
+// members of that guild who can view the channel and DM typing to the other
+// participant, once the typist is known to belong there. Who can view a guild
+// channel is asked from the API with the typist's session and cached for
+// channelViewersTTL; when the API cannot answer, the indicator is dropped.
+// Who is typing is kept in Redis sorted sets scored by expiry so GET_TYPING
+// answers the same on every node:
+//
+//	typing:{guildId}:{channelId}  guild channel typists
+//	typing:dm:{recipientId}       users typing to recipientId in DMs
+//	typing_opt_out                users who do not share their typing
+//
+// The timer that sends the automatic STOP_TYPING lives on the typist's node.
+
+const (
+	typingTimeoutSeconds = 5
+
+	typingPrefix    = "typing:"
+	typingOptOutKey = "typing_opt_out"
+
+	channelViewersTTL = 30 * time.Second
+)
+
 type TypingEvent struct {
 	UserId        string `json:"userId"`
 	GuildId       string `json:"guildId,omitempty"`
@@ -16,96 +41,287 @@ type TypingEvent struct {
 	TypingStopped bool   `json:"typingStopped,omitempty"`
 }
 
-var typingStates = sync.Map{}
-var typingTimeouts = sync.Map{}
+type TypingTarget struct {
+	ChannelId string `json:"channelId"`
+	GuildId   string `json:"guildId,omitempty"`
+}
 
-const typingTimeoutSeconds = 5
+type TypingSnapshotResponse struct {
+	GuildId   string   `json:"guildId,omitempty"`
+	ChannelId string   `json:"channelId"`
+	UserIds   []string `json:"userIds"`
+}
 
-func handleStartTyping(conn *websocket.Conn, event EventMessage, userId string) {
-	var payload struct {
-		ChannelId string `json:"channelId"`
-		GuildId   string `json:"guildId,omitempty"`
+type TypingSettings struct {
+	ShareTyping bool `json:"shareTyping"`
+}
+
+// typingScope is a resolved typing target: where the state is stored, who
+// should hear about it and the event they receive.
+type typingScope struct {
+	key        string
+	recipients []string
+	event      TypingEvent
+}
+
+type channelViewersResponse struct {
+	UserIds []string `json:"userIds"`
+}
+
+type viewerEntry struct {
+	userIds   map[string]struct{}
+	expiresAt time.Time
+}
+
+// viewerCache holds who can view each guild channel, keyed by
+// guildId:channelId.
+type viewerCache struct {
+	mu      sync.Mutex
+	entries map[string]viewerEntry
+}
+
+var channelViewers = &viewerCache{entries: make(map[string]viewerEntry)}
+
+// get returns the members who can view the channel, asking the API with
+// token when the cached answer is missing or expired.
+func (c *viewerCache) get(guildId, channelId, token string) (map[string]struct{}, error) {
+	key := guildId + ":" + channelId
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.userIds, nil
 	}
-	if err := json.Unmarshal(event.Payload, &payload); err != nil {
-		return
+
+	var response channelViewersResponse
+	if err := fetchAsUser(token, "/api/v1/guilds/"+url.PathEscape(guildId)+"/channels/"+url.PathEscape(channelId)+"/viewers", &response); err != nil {
+		return nil, err
+	}
+	entry = viewerEntry{
+		userIds:   make(map[string]struct{}, len(response.UserIds)),
+		expiresAt: now.Add(channelViewersTTL),
+	}
+	for _, userId := range response.UserIds {
+		entry.userIds[userId] = struct{}{}
 	}
 
-	key := fmt.Sprintf("%s_%s", payload.ChannelId, payload.GuildId)
+	c.mu.Lock()
+	for k, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+	c.mu.Unlock()
+	return entry.userIds, nil
+}
+
+// visibleTo returns who can view the guild channel, provided userId is one
+// of them.
+func (c *viewerCache) visibleTo(userId, guildId, channelId string) (map[string]struct{}, bool) {
+	if !memberships.isMember(guildId, userId) {
+		return nil, false
+	}
+	viewers, err := c.get(guildId, channelId, localToken(userId))
+	if err != nil {
+		logErr("Error loading viewers of channel "+channelId, err)
+		return nil, false
+	}
+	_, ok := viewers[userId]
+	return viewers, ok
+}
 
-	state, _ := typingStates.LoadOrStore(key, make(map[string]bool))
-	userMap := state.(map[string]bool)
-	userMap[userId] = true
-	typingStates.Store(key, userMap)
+type typingTracker struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
 
-	typingTimeouts.Store(userId, time.Now().Add(time.Second*typingTimeoutSeconds))
+var typing = &typingTracker{timers: make(map[string]*time.Timer)}
 
-	message := TypingEvent{
-		UserId:    userId,
-		GuildId:   payload.GuildId,
-		ChannelId: payload.ChannelId,
+// resolveTypingScope validates that userId may type in the target and works
+// out who receives the indicator.
+func resolveTypingScope(userId string, target TypingTarget) (typingScope, bool) {
+	if target.ChannelId == "" {
+		return typingScope{}, false
 	}
 
-	EmitToGuild("START_TYPING", message, key, userId)
+	if target.GuildId != "" {
+		viewers, ok := channelViewers.visibleTo(userId, target.GuildId, target.ChannelId)
+		if !ok {
+			return typingScope{}, false
+		}
+		var recipients []string
+		for viewerId := range viewers {
+			if viewerId != userId {
+				recipients = append(recipients, viewerId)
+			}
+		}
+		return typingScope{
+			key:        typingPrefix + target.GuildId + ":" + target.ChannelId,
+			recipients: recipients,
+			event:      TypingEvent{UserId: userId, GuildId: target.GuildId, ChannelId: target.ChannelId},
+		}, true
+	}
 
-	go checkTypingTimeout(userId, key, payload.GuildId, payload.ChannelId)
+	// In DMs the channel is the other user, and from their side the channel
+	// is the typist.
+	peerId := target.ChannelId
+	if !memberships.areDmPeers(userId, peerId) {
+		return typingScope{}, false
+	}
+	return typingScope{
+		key:        typingPrefix + "dm:" + peerId,
+		recipients: []string{peerId},
+		event:      TypingEvent{UserId: userId, ChannelId: userId},
+	}, true
+}
+
+func handleStartTyping(conn *websocket.Conn, event EventMessage, userId string) {
+	var target TypingTarget
+	if err := json.Unmarshal(event.Payload, &target); err != nil {
+		return
+	}
+	noteActivity(userId, conn)
+	if !sharesTyping(userId) {
+		return
+	}
+	scope, ok := resolveTypingScope(userId, target)
+	if !ok {
+		return
+	}
+
+	expiresAt := time.Now().Add(typingTimeoutSeconds * time.Second)
+	pipe := redisClient.Pipeline()
+	pipe.ZAdd(ctx, scope.key, &redis.Z{Score: float64(expiresAt.UnixMilli()), Member: userId})
+	pipe.Expire(ctx, scope.key, 2*typingTimeoutSeconds*time.Second)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logErr("Error storing typing state", err)
+	}
+
+	typing.arm(userId, scope)
+	deliverToUsers("START_TYPING", scope.event, scope.recipients)
 }
 
 func handleStopTyping(conn *websocket.Conn, event EventMessage, userId string) {
-	var payload struct {
-		ChannelId string `json:"channelId"`
-		GuildId   string `json:"guildId,omitempty"`
+	var target TypingTarget
+	if err := json.Unmarshal(event.Payload, &target); err != nil {
+		return
 	}
-	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+	scope, ok := resolveTypingScope(userId, target)
+	if !ok {
 		return
 	}
 
-	key := fmt.Sprintf("%s_%s", payload.ChannelId, payload.GuildId)
+	typing.stop(userId, scope)
+}
+
+// arm starts or extends the timeout after which the user stops typing.
+func (t *typingTracker) arm(userId string, scope typingScope) {
+	timerKey := userId + "|" + scope.key
 
-	if state, ok := typingStates.Load(key); ok {
-		userMap := state.(map[string]bool)
-		delete(userMap, userId)
-		typingStates.Store(key, userMap)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if timer, ok := t.timers[timerKey]; ok {
+		timer.Reset(typingTimeoutSeconds * time.Second)
+		return
 	}
+	t.timers[timerKey] = time.AfterFunc(typingTimeoutSeconds*time.Second, func() {
+		t.stop(userId, scope)
+	})
+}
 
-	typingTimeouts.Delete(userId)
+func (t *typingTracker) stop(userId string, scope typingScope) {
+	timerKey := userId + "|" + scope.key
+
+	t.mu.Lock()
+	if timer, ok := t.timers[timerKey]; ok {
+		timer.Stop()
+		delete(t.timers, timerKey)
+	}
+	t.mu.Unlock()
 
-	message := TypingEvent{
-		UserId:        userId,
-		GuildId:       payload.GuildId,
-		ChannelId:     payload.ChannelId,
-		TypingStopped: true,
+	if err := redisClient.ZRem(ctx, scope.key, userId).Err(); err != nil {
+		logErr("Error clearing typing state", err)
 	}
 
-	EmitToGuild("STOP_TYPING", message, key, userId)
+	stopped := scope.event
+	stopped.TypingStopped = true
+	deliverToUsers("STOP_TYPING", stopped, scope.recipients)
 }
 
-func checkTypingTimeout(userId, key string, guildId, channelId string) {
-	time.Sleep(typingTimeoutSeconds * time.Second)
+// handleGetTyping answers with the users currently typing in a channel, for
+// clients that open it while someone is already typing.
+func handleGetTyping(conn *websocket.Conn, event EventMessage, userId string) {
+	var target TypingTarget
+	if err := json.Unmarshal(event.Payload, &target); err != nil || target.ChannelId == "" {
+		return
+	}
 
-	if timeout, ok := typingTimeouts.Load(userId); ok {
-		if time.Now().After(timeout.(time.Time)) {
-			handleTimeoutStopTyping(userId, key, guildId, channelId)
-		}
+	ws := findConnection(userId, conn)
+	if ws == nil {
+		return
 	}
-}
 
-func handleTimeoutStopTyping(userId, key string, guildId, channelId string) {
-	if state, ok := typingStates.Load(key); ok {
-		userMap := state.(map[string]bool)
-		if _, exists := userMap[userId]; exists {
-			delete(userMap, userId)
-			typingStates.Store(key, userMap)
+	snapshot := TypingSnapshotResponse{
+		GuildId:   target.GuildId,
+		ChannelId: target.ChannelId,
+		UserIds:   []string{},
+	}
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	if target.GuildId != "" {
+		if _, ok := channelViewers.visibleTo(userId, target.GuildId, target.ChannelId); !ok {
+			return
+		}
+		typists, err := redisClient.ZRangeByScore(ctx, typingPrefix+target.GuildId+":"+target.ChannelId, &redis.ZRangeBy{
+			Min: "(" + now,
+			Max: "+inf",
+		}).Result()
+		if err != nil {
+			logErr("Error reading typing state", err)
+		}
+		for _, typistId := range typists {
+			if typistId != userId {
+				snapshot.UserIds = append(snapshot.UserIds, typistId)
+			}
+		}
+	} else {
+		peerId := target.ChannelId
+		expiresAt, err := redisClient.ZScore(ctx, typingPrefix+"dm:"+userId, peerId).Result()
+		if err == nil && expiresAt > float64(time.Now().UnixMilli()) {
+			snapshot.UserIds = append(snapshot.UserIds, peerId)
 		}
 	}
 
-	typingTimeouts.Delete(userId)
+	writeToConn(ws, "TYPING_SNAPSHOT", snapshot)
+}
+
+// handleUpdateTypingSettings lets a user stop sharing their typing. The new
+// setting is echoed to all of the user's sessions.
+func handleUpdateTypingSettings(conn *websocket.Conn, event EventMessage, userId string) {
+	var settings TypingSettings
+	if err := json.Unmarshal(event.Payload, &settings); err != nil {
+		rejectEvent(conn, userId, event, errorInvalidPayload, err)
+		return
+	}
 
-	message := TypingEvent{
-		UserId:        userId,
-		GuildId:       guildId,
-		ChannelId:     channelId,
-		TypingStopped: true,
+	var err error
+	if settings.ShareTyping {
+		err = redisClient.SRem(ctx, typingOptOutKey, userId).Err()
+	} else {
+		err = redisClient.SAdd(ctx, typingOptOutKey, userId).Err()
 	}
+	if err != nil {
+		logErr("Error saving typing settings", err)
+		return
+	}
+
+	deliverToUsers("TYPING_SETTINGS", settings, []string{userId})
+}
 
-	EmitToGuild("STOP_TYPING", message, key, userId)
+func sharesTyping(userId string) bool {
+	optedOut, err := redisClient.SIsMember(ctx, typingOptOutKey, userId).Result()
+	return err != nil || !optedOut
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestResolveTypingScopeOnlyReachesChannelViewers(t *testing.T) {
+	startFakeRedis(t)
+
+	var requests []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("Authorization"))
+		if r.URL.Path != "/api/v1/guilds/guild/channels/private/viewers" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"guildId":"guild","channelId":"private","userIds":["typist","reader"]}`))
+	}))
+	defer api.Close()
+
+	previousAuth := authenticator
+	authenticator = newSessionAuthenticator(api.URL)
+	memberships.setGuild("guild", []string{"typist", "reader", "outsider"})
+	hub.lock.Lock()
+	hub.clients["typist"] = []*WSConnection{{token: "typist-token"}}
+	hub.clients["outsider"] = []*WSConnection{{token: "outsider-token"}}
+	hub.lock.Unlock()
+	t.Cleanup(func() {
+		authenticator = previousAuth
+		memberships.dropGuild("guild")
+		channelViewers.mu.Lock()
+		channelViewers.entries = make(map[string]viewerEntry)
+		channelViewers.mu.Unlock()
+		hub.lock.Lock()
+		delete(hub.clients, "typist")
+		delete(hub.clients, "outsider")
+		hub.lock.Unlock()
+	})
+
+	scope, ok := resolveTypingScope("typist", TypingTarget{GuildId: "guild", ChannelId: "private"})
+	if !ok {
+		t.Fatal("viewer should be allowed to type")
+	}
+	sort.Strings(scope.recipients)
+	if !reflect.DeepEqual(scope.recipients, []string{"reader"}) {
+		t.Fatalf("recipients = %v, want only the other viewer", scope.recipients)
+	}
+
+	if _, ok := resolveTypingScope("outsider", TypingTarget{GuildId: "guild", ChannelId: "private"}); ok {
+		t.Fatal("member who cannot view the channel should not be allowed to type")
+	}
+	if _, ok := resolveTypingScope("typist", TypingTarget{GuildId: "guild", ChannelId: "other-guilds-channel"}); ok {
+		t.Fatal("typing in a channel the API does not know should be rejected")
+	}
+	if len(requests) != 2 || requests[0] != "/api/v1/guilds/guild/channels/private/viewers Bearer typist-token" {
+		t.Fatalf("viewer requests = %q, want one per channel, cached afterwards", requests)
+	}
+}
@@ -5,9 +5,10 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 )
 
@@ -24,26 +25,44 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
-func sendJSON(conn *websocket.Conn, env Envelope) {
-	b, err := json.Marshal(env)
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
 	if err != nil {
-		return
+		return defaultValue
 	}
-	_ = conn.WriteMessage(websocket.TextMessage, b)
+	return value
 }
 
-func mustJSON(v interface{}) json.RawMessage {
-	b, _ := json.Marshal(v)
-	return b
+func getEnvSeconds(key string, defaultValue time.Duration) time.Duration {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return time.Duration(value) * time.Second
 }
 
-func upgradeConnection(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
-	var hdr http.Header
-	if len(r.Header["Sec-Websocket-Protocol"]) > 0 {
-		hdr = http.Header{}
-		hdr.Set("Sec-WebSocket-Protocol", r.Header.Get("Sec-WebSocket-Protocol"))
+// getEnvList reads a comma separated list, lowercased and without blanks.
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			list = append(list, item)
+		}
 	}
-	return vcUpgrader.Upgrade(w, r, hdr)
+	return list
+}
+
+func mustJSON(v interface{}) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
 }
 
 func enableCORS(w http.ResponseWriter, r *http.Request) {
@@ -62,17 +81,6 @@ func enableCORS(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
-
-func extractToken(r *http.Request) string {
-	if protocols, ok := r.Header["Sec-Websocket-Protocol"]; ok {
-		for _, p := range protocols {
-			if strings.HasPrefix(p, "cookie-") {
-				return strings.TrimPrefix(p, "cookie-")
-			}
-		}
-	}
-	return r.URL.Query().Get("token")
-}
 func unmarshalPayload(event EventMessage, v interface{}) error {
 	return json.Unmarshal(event.Payload, v)
 }
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Web Push delivery: payloads are encrypted with the aes128gcm content
+// encoding of RFC 8291 and requests are signed with VAPID (RFC 8292), using
+// only the standard library.
+
+const (
+	pushRecordSize   = 4096
+	pushSaltLength   = 16
+	pushAuthLength   = 16
+	pushTagLength    = 16
+	vapidTokenTTL    = 12 * time.Hour
+	vapidTokenReuse  = time.Hour
+	pushSendTimeout  = 10 * time.Second
+	pushTopicHashLen = 24
+)
+
+var errPushGone = errors.New("push subscription is gone")
+
+// pushServiceHosts are the push services browsers hand out endpoints for.
+// Endpoints on any other host are refused, so a subscription cannot make the
+// gateway POST to internal addresses; PushAllowedHosts adds self-hosted ones.
+var pushServiceHosts = []string{
+	"fcm.googleapis.com",
+	"android.googleapis.com",
+	"push.services.mozilla.com",
+	"push.apple.com",
+	"notify.windows.com",
+}
+
+type PushSubscriptionKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// PushSubscription is what the browser's PushManager.subscribe returns.
+type PushSubscription struct {
+	Endpoint string               `json:"endpoint"`
+	Keys     PushSubscriptionKeys `json:"keys"`
+}
+
+// pushMessage is one notification for one subscription.
+type pushMessage struct {
+	payload []byte
+	topic   string
+	urgency string
+}
+
+type vapidToken struct {
+	header    string
+	expiresAt time.Time
+}
+
+// vapidSigner signs push requests with the server's VAPID key and reuses a
+// token per push service until it gets close to expiring.
+type vapidSigner struct {
+	key       *ecdsa.PrivateKey
+	publicKey string
+	subject   string
+
+	mu     sync.Mutex
+	tokens map[string]vapidToken
+}
+
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// newVapidSigner parses a base64url encoded raw P-256 private key, the format
+// web-push tooling generates.
+func newVapidSigner(privateKey, subject string) (*vapidSigner, error) {
+	raw, err := decodeBase64URL(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("decoding VAPID private key: %w", err)
+	}
+	key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing VAPID private key: %w", err)
+	}
+	public, err := key.PublicKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &vapidSigner{
+		key:       key,
+		publicKey: base64.RawURLEncoding.EncodeToString(public),
+		subject:   subject,
+		tokens:    make(map[string]vapidToken),
+	}, nil
+}
+
+// authorization returns the Authorization header for a request to endpoint.
+// The token's audience is the origin of the push service.
+func (s *vapidSigner) authorization(endpoint *url.URL) (string, error) {
+	audience := endpoint.Scheme + "://" + endpoint.Host
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token, ok := s.tokens[audience]; ok && now.Add(vapidTokenReuse).Before(token.expiresAt) {
+		return token.header, nil
+	}
+
+	expiresAt := now.Add(vapidTokenTTL)
+	claims := map[string]interface{}{
+		"aud": audience,
+		"exp": expiresAt.Unix(),
+	}
+	if s.subject != "" {
+		claims["sub"] = s.subject
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	signingInput := encoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." + encoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, sig, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS wants the signature as the fixed-size r || s, not ASN.1.
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	sig.FillBytes(signature[32:])
+
+	header := "vapid t=" + signingInput + "." + encoding.EncodeToString(signature) + ", k=" + s.publicKey
+	s.tokens[audience] = vapidToken{header: header, expiresAt: expiresAt}
+	return header, nil
+}
+
+// subscriptionKeys decodes and checks the keys of a subscription.
+func subscriptionKeys(sub PushSubscription) (*ecdh.PublicKey, []byte, error) {
+	rawPublic, err := decodeBase64URL(sub.Keys.P256dh)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding p256dh: %w", err)
+	}
+	public, err := ecdh.P256().NewPublicKey(rawPublic)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing p256dh: %w", err)
+	}
+	auth, err := decodeBase64URL(sub.Keys.Auth)
+	if err != nil || len(auth) != pushAuthLength {
+		return nil, nil, errors.New("auth secret must be 16 bytes")
+	}
+	return public, auth, nil
+}
+
+// encryptPushPayload encrypts plaintext for the subscription as a single
+// aes128gcm record.
+func encryptPushPayload(sub PushSubscription, plaintext []byte) ([]byte, error) {
+	userAgentKey, authSecret, err := subscriptionKeys(sub)
+	if err != nil {
+		return nil, err
+	}
+	// The single record holds the payload, its delimiter and the GCM tag.
+	if len(plaintext)+1+pushTagLength > pushRecordSize {
+		return nil, fmt.Errorf("push payload of %d bytes is too large", len(plaintext))
+	}
+
+	serverKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, pushSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptPushRecord(userAgentKey, authSecret, serverKey, salt, plaintext)
+}
+
+// encryptPushRecord does the RFC 8291 key derivation and encryption with a
+// given ephemeral key and salt.
+func encryptPushRecord(userAgentKey *ecdh.PublicKey, authSecret []byte, serverKey *ecdh.PrivateKey, salt, plaintext []byte) ([]byte, error) {
+	sharedSecret, err := serverKey.ECDH(userAgentKey)
+	if err != nil {
+		return nil, err
+	}
+	serverPublic := serverKey.PublicKey().Bytes()
+
+	keyInfo := "WebPush: info\x00" + string(userAgentKey.Bytes()) + string(serverPublic)
+	ikm, err := hkdf.Key(sha256.New, sharedSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(pushRecordSize))
+	body.WriteByte(byte(len(serverPublic)))
+	body.Write(serverPublic)
+	// 0x02 marks the last (and only) record.
+	record := append(append([]byte(nil), plaintext...), 0x02)
+	body.Write(gcm.Seal(nil, nonce, record, nil))
+	return body.Bytes(), nil
+}
+
+// pushTopic turns a collapse key into a Topic header value, which push
+// services limit to 32 base64url characters. Undelivered messages with the
+// same topic replace each other.
+func pushTopic(collapseKey string) string {
+	digest := sha256.Sum256([]byte(collapseKey))
+	return base64.RawURLEncoding.EncodeToString(digest[:pushTopicHashLen])
+}
+
+// validPushEndpoint only accepts https endpoints on a known push service, or
+// http ones when PushAllowInsecureEndpoints is set for a local push service
+// stand-in. It is checked when a subscription is stored and before each send.
+func validPushEndpoint(endpoint string) (*url.URL, bool) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Host == "" || parsed.User != nil {
+		return nil, false
+	}
+	switch parsed.Scheme {
+	case "https":
+	case "http":
+		if !cfg.PushAllowInsecureEndpoints {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	if !isPushServiceHost(parsed.Hostname()) {
+		return nil, false
+	}
+	return parsed, true
+}
+
+func isPushServiceHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, list := range [][]string{pushServiceHosts, cfg.PushAllowedHosts} {
+		for _, allowed := range list {
+			if host == allowed || strings.HasSuffix(host, "."+allowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Push services answer directly; following a redirect could lead anywhere.
+var pushHTTPClient = &http.Client{
+	Timeout: pushSendTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// sendPush delivers one message to a push service. errPushGone means the
+// subscription expired or was revoked and should be forgotten.
+func sendPush(signer *vapidSigner, sub PushSubscription, message pushMessage) error {
+	endpoint, ok := validPushEndpoint(sub.Endpoint)
+	if !ok {
+		return errPushGone
+	}
+	body, err := encryptPushPayload(sub, message.payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := signer.authorization(endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(cfg.PushTTL.Seconds())))
+	if message.topic != "" {
+		req.Header.Set("Topic", message.topic)
+	}
+	if message.urgency != "" {
+		req.Header.Set("Urgency", message.urgency)
+	}
+
+	resp, err := pushHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errPushGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func mustDecodeBase64URL(t *testing.T, value string) []byte {
+	t.Helper()
+	b, err := decodeBase64URL(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// withPushConfig lets the tests deliver to an httptest server.
+func withPushConfig(t *testing.T) {
+	t.Helper()
+	previous := cfg
+	cfg.PushAllowInsecureEndpoints = true
+	cfg.PushAllowedHosts = []string{"127.0.0.1"}
+	cfg.PushTTL = time.Hour
+	t.Cleanup(func() { cfg = previous })
+}
+
+// The example from RFC 8291 Appendix A.
+func TestEncryptPushRecordRFC8291(t *testing.T) {
+	const (
+		plaintext       = "When I grow up, I want to be a watermelon"
+		serverPrivate   = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+		userAgentPublic = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+		authSecret      = "BTBZMqHH6r4Tts7J_aSIgg"
+		salt            = "DGv6ra1nlYgDCS1FRnbzlw"
+		expected        = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	)
+
+	serverKey, err := ecdh.P256().NewPrivateKey(mustDecodeBase64URL(t, serverPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	userAgentKey, err := ecdh.P256().NewPublicKey(mustDecodeBase64URL(t, userAgentPublic))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := encryptPushRecord(userAgentKey, mustDecodeBase64URL(t, authSecret), serverKey, mustDecodeBase64URL(t, salt), []byte(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := base64.RawURLEncoding.EncodeToString(body); got != expected {
+		t.Fatalf("body mismatch\n got %s\nwant %s", got, expected)
+	}
+}
+
+func TestValidPushEndpoint(t *testing.T) {
+	previous := cfg
+	t.Cleanup(func() { cfg = previous })
+	cfg.PushAllowInsecureEndpoints = false
+	cfg.PushAllowedHosts = []string{"push.example.org"}
+
+	tests := []struct {
+		endpoint string
+		valid    bool
+	}{
+		{"https://fcm.googleapis.com/fcm/send/abc", true},
+		{"https://updates.push.services.mozilla.com/wpush/v2/abc", true},
+		{"https://web.push.apple.com/abc", true},
+		{"https://db5p.notify.windows.com/w/?token=abc", true},
+		{"https://push.example.org/abc", true},
+		{"https://FCM.googleapis.com./abc", true},
+		{"http://fcm.googleapis.com/abc", false},
+		{"https://fcm.googleapis.com.evil.com/abc", false},
+		{"https://evilfcm.googleapis.com/abc", false},
+		{"https://localhost/abc", false},
+		{"https://127.0.0.1/abc", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+		{"https://user@fcm.googleapis.com/abc", false},
+		{"ftp://fcm.googleapis.com/abc", false},
+		{"not a url", false},
+	}
+	for _, tt := range tests {
+		if _, ok := validPushEndpoint(tt.endpoint); ok != tt.valid {
+			t.Errorf("validPushEndpoint(%q) = %v, want %v", tt.endpoint, ok, tt.valid)
+		}
+	}
+}
+
+type testUserAgent struct {
+	key  *ecdh.PrivateKey
+	auth []byte
+}
+
+func newTestUserAgent(t *testing.T) testUserAgent {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, pushAuthLength)
+	rand.Read(auth)
+	return testUserAgent{key: key, auth: auth}
+}
+
+func (ua testUserAgent) subscription(endpoint string) PushSubscription {
+	return PushSubscription{
+		Endpoint: endpoint,
+		Keys: PushSubscriptionKeys{
+			P256dh: base64.RawURLEncoding.EncodeToString(ua.key.PublicKey().Bytes()),
+			Auth:   base64.RawURLEncoding.EncodeToString(ua.auth),
+		},
+	}
+}
+
+// decrypt is the user agent's side of RFC 8291.
+func (ua testUserAgent) decrypt(t *testing.T, body []byte) []byte {
+	t.Helper()
+	if len(body) < pushSaltLength+5 {
+		t.Fatalf("body of %d bytes is too short", len(body))
+	}
+	salt := body[:pushSaltLength]
+	if rs := binary.BigEndian.Uint32(body[pushSaltLength:]); rs != pushRecordSize {
+		t.Fatalf("record size %d", rs)
+	}
+	idLen := int(body[pushSaltLength+4])
+	keyId := body[pushSaltLength+5 : pushSaltLength+5+idLen]
+	ciphertext := body[pushSaltLength+5+idLen:]
+
+	serverKey, err := ecdh.P256().NewPublicKey(keyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := ua.key.ECDH(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := "WebPush: info\x00" + string(ua.key.PublicKey().Bytes()) + string(keyId)
+	ikm, _ := hkdf.Key(sha256.New, shared, ua.auth, info, 32)
+	prk, _ := hkdf.Extract(sha256.New, ikm, salt)
+	contentKey, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+
+	block, _ := aes.NewCipher(contentKey)
+	gcm, _ := cipher.NewGCM(block)
+	record, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("decrypting: %v", err)
+	}
+	record = bytes.TrimRight(record, "\x00")
+	if len(record) == 0 || record[len(record)-1] != 0x02 {
+		t.Fatal("missing last record delimiter")
+	}
+	return record[:len(record)-1]
+}
+
+// verifyVapid checks the Authorization header of a push request and returns
+// its claims.
+func verifyVapid(t *testing.T, header, publicKey string) map[string]interface{} {
+	t.Helper()
+	params, ok := strings.CutPrefix(header, "vapid ")
+	if !ok {
+		t.Fatalf("authorization %q is not vapid", header)
+	}
+	var token, key string
+	for _, part := range strings.Split(params, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "t":
+			token = value
+		case "k":
+			key = value
+		}
+	}
+	if key != publicKey {
+		t.Fatalf("k = %q, want %q", key, publicKey)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token has %d parts", len(parts))
+	}
+	var jwtHeader map[string]string
+	if err := json.Unmarshal(mustDecodeBase64URL(t, parts[0]), &jwtHeader); err != nil || jwtHeader["alg"] != "ES256" {
+		t.Fatalf("bad JWT header %v", jwtHeader)
+	}
+
+	public, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), mustDecodeBase64URL(t, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := mustDecodeBase64URL(t, parts[2])
+	if len(signature) != 64 {
+		t.Fatalf("signature is %d bytes", len(signature))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(public, digest[:], r, s) {
+		t.Fatal("VAPID signature does not verify")
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(mustDecodeBase64URL(t, parts[1]), &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func newTestSigner(t *testing.T) *vapidSigner {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newVapidSigner(base64.RawURLEncoding.EncodeToString(key.Bytes()), "mailto:ops@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestSendPushToStandIn(t *testing.T) {
+	withPushConfig(t)
+	signer := newTestSigner(t)
+	ua := newTestUserAgent(t)
+
+	var (
+		mu      sync.Mutex
+		body    []byte
+		headers http.Header
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ = io.ReadAll(r.Body)
+		headers = r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	payload := []byte(`{"type":"mention","content":"hello"}`)
+	message := pushMessage{payload: payload, topic: pushTopic("channel"), urgency: "high"}
+	if err := sendPush(signer, ua.subscription(server.URL+"/push/abc"), message); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if received := ua.decrypt(t, body); !bytes.Equal(received, payload) {
+		t.Fatalf("decrypted %q, want %q", received, payload)
+	}
+	claims := verifyVapid(t, headers.Get("Authorization"), signer.publicKey)
+	origin, _ := url.Parse(server.URL)
+	if claims["aud"] != "http://"+origin.Host {
+		t.Errorf("aud = %v, want %s", claims["aud"], "http://"+origin.Host)
+	}
+	if claims["sub"] != "mailto:ops@example.org" {
+		t.Errorf("sub = %v", claims["sub"])
+	}
+	if exp, _ := claims["exp"].(float64); int64(exp) <= time.Now().Unix() {
+		t.Errorf("exp %v is not in the future", claims["exp"])
+	}
+	for name, want := range map[string]string{
+		"Content-Encoding": "aes128gcm",
+		"Ttl":              "3600",
+		"Topic":            message.topic,
+		"Urgency":          "high",
+	} {
+		if got := headers.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDeliverPushForgetsGoneSubscriptions(t *testing.T) {
+	withPushConfig(t)
+	fake := startFakeRedis(t)
+	signer := newTestSigner(t)
+	ua := newTestUserAgent(t)
+
+	var mu sync.Mutex
+	var delivered [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/failing":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			mu.Lock()
+			delivered = append(delivered, body)
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	key := pushSubscriptionsPrefix + "u1"
+	for _, path := range []string{"/ok", "/gone", "/missing", "/failing"} {
+		sub := ua.subscription(server.URL + path)
+		if err := redisClient.HSet(ctx, key, sub.Endpoint, []byte(mustJSON(sub))).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deliverPush(signer, pushJob{userId: "u1", notification: PushNotification{Type: "mention", ChannelId: "c1", Tag: "c1"}})
+
+	fake.mu.Lock()
+	remaining := make([]string, 0)
+	for endpoint := range fake.hashes[key] {
+		remaining = append(remaining, strings.TrimPrefix(endpoint, server.URL))
+	}
+	fake.mu.Unlock()
+	if len(remaining) != 2 || !containsAll(remaining, "/ok", "/failing") {
+		t.Fatalf("remaining subscriptions %v, want /ok and /failing", remaining)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 1 {
+		t.Fatalf("delivered %d notifications, want 1", len(delivered))
+	}
+	if plaintext := ua.decrypt(t, delivered[0]); !strings.Contains(string(plaintext), `"channelId":"c1"`) {
+		t.Fatalf("delivered %s", plaintext)
+	}
+}
+
+func containsAll(list []string, want ...string) bool {
+	set := make(map[string]bool, len(list))
+	for _, item := range list {
+		set[item] = true
+	}
+	for _, item := range want {
+		if !set[item] {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -12,11 +13,28 @@ import (
 
 var upgrader = newWsUpgrader()
 
-var eventHandlers = map[string]func(*websocket.Conn, EventMessage, string){
-	"UPDATE_USER_STATUS": handleUpdateUserStatus,
-	"GET_USER_STATUS":    handleGetUserStatus,
-	"START_TYPING":       handleStartTyping,
-	"STOP_TYPING":        handleStopTyping,
+// eventCatalog lists every event a client may send on /ws, with the payload
+// it is validated against before the handler runs (see protocol.go).
+var eventCatalog = map[string]eventSpec{
+	"UPDATE_USER_STATUS":           {handler: handleUpdateUserStatus, payload: UpdateUserStatusPayload{}, required: []string{"status"}},
+	"GET_USER_STATUS":              {handler: handleGetUserStatus, payload: GetUserStatusPayload{}, required: []string{"user_ids"}},
+	"START_TYPING":                 {handler: handleStartTyping, payload: TypingTarget{}, required: []string{"channelId"}},
+	"STOP_TYPING":                  {handler: handleStopTyping, payload: TypingTarget{}, required: []string{"channelId"}},
+	"RESUME":                       {handler: handleResume, payload: ResumePayload{}, required: []string{"sessionId"}},
+	"IDENTIFY":                     {handler: handleIdentify, payload: ClientProperties{}},
+	"HEARTBEAT":                    {handler: handleHeartbeat, payload: HeartbeatPayload{}},
+	"SUBSCRIBE":                    {handler: handleSubscribe, payload: SubscribePayload{}},
+	"GET_TYPING":                   {handler: handleGetTyping, payload: TypingTarget{}, required: []string{"channelId"}},
+	"UPDATE_TYPING_SETTINGS":       {handler: handleUpdateTypingSettings, payload: TypingSettings{}, required: []string{"shareTyping"}},
+	"ACTIVITY":                     {handler: handleActivity},
+	"SET_CUSTOM_STATUS":            {handler: handleSetCustomStatus, payload: CustomStatus{}},
+	"SET_ACTIVITIES":               {handler: handleSetActivities, payload: SetActivitiesPayload{}, required: []string{"activities"}},
+	"MESSAGE_ACK":                  {handler: handleMessageAck, payload: MessageAckPayload{}, required: []string{"channelId", "messageId"}},
+	"GET_READ_STATE":               {handler: handleGetReadState},
+	"UPDATE_READ_RECEIPT_SETTINGS": {handler: handleUpdateReadReceiptSettings, payload: ReadReceiptSettings{}, required: []string{"sendReadReceipts"}},
+	"REGISTER_PUSH_SUBSCRIPTION":   {handler: handleRegisterPushSubscription, payload: PushSubscription{}, required: []string{"endpoint", "keys"}},
+	"UNREGISTER_PUSH_SUBSCRIPTION": {handler: handleUnregisterPushSubscription, payload: UnregisterPushSubscriptionPayload{}, required: []string{"endpoint"}},
+	"UPDATE_NOTIFICATION_SETTINGS": {handler: handleUpdateNotificationSettings, payload: NotificationSettings{}, required: []string{"muteRules"}},
 }
 
 var disconnectTimers = struct {
@@ -25,16 +43,21 @@ var disconnectTimers = struct {
 }{timers: make(map[string]*time.Timer)}
 
 func handleWebSocket(c *gin.Context) {
-	userId, conn, err := establishWebSocketConnection(c)
+	userId, token, conn, err := establishWebSocketConnection(c)
 	if err != nil {
 		return
 	}
+	version, supported := negotiateProtocolVersion(c.Request)
+	if !supported {
+		closeUnsupportedVersion(conn)
+		return
+	}
 
-	registerClient(userId, conn)
-	go handleWebSocketMessages(userId, conn)
+	ws := registerClient(userId, token, conn, newFrameCompressor(c.Request, conn), codecForRequest(c.Request), version)
+	go handleWebSocketMessages(userId, ws)
 }
 
-func registerClient(userId string, conn *websocket.Conn) {
+func registerClient(userId, token string, conn *websocket.Conn, compressor *frameCompressor, wc *wireCodec, version int) *WSConnection {
 	disconnectTimers.Lock()
 	if t, ok := disconnectTimers.timers[userId]; ok {
 		t.Stop()
@@ -43,24 +66,34 @@ func registerClient(userId string, conn *websocket.Conn) {
 	disconnectTimers.Unlock()
 
 	hub.lock.Lock()
-
-	ws := &WSConnection{Conn: conn}
+	ws := newWSConnection(conn, compressor, wc)
+	ws.token = token
+	ws.version = version
+	session := sessions.create(userId, ws)
 	hub.clients[userId] = append(hub.clients[userId], ws)
+	hub.lock.Unlock()
 
-	if _, exists := hub.status[userId]; !exists {
-		hub.status[userId] = Online
+	// Redis round trips stay out of hub.lock so a slow one does not hold up
+	// every broadcast and disconnect.
+	cluster.registerSession(userId, session.ID)
+	presence.markLive(userId)
+	devices.sync(userId)
+	chosenStatus := presence.chosenStatus(userId)
+	if chosenStatus == StatusOnline {
+		activity.reset(userId)
 	}
 
-	effectiveStatus := hub.status[userId]
+	sendHello(ws)
+	writeToConn(ws, "READY", SessionReadyResponse{SessionID: session.ID, UserID: userId})
+	writeToConn(ws, "UPDATE_USER_STATUS", presence.describe(userId, chosenStatus))
+	writeToConn(ws, "TYPING_SETTINGS", TypingSettings{ShareTyping: sharesTyping(userId)})
+	writeToConn(ws, "MENTION_COUNTS", mentionCounts(userId))
+	writeToConn(ws, notificationSettingsEvent, notificationSettingsResponse(notificationSettings(userId)))
 
-	hub.lock.Unlock()
-
-	writeToConn(ws, "UPDATE_USER_STATUS", UserStatusResponse{
-		UserId: userId,
-		Status: effectiveStatus,
-	})
-
-	go broadcastStatusUpdate(userId, effectiveStatus)
+	if chosenStatus != StatusInvisible {
+		go broadcastStatusUpdate(userId, chosenStatus)
+	}
+	return ws
 }
 
 func removeConnection(userId string, conn *websocket.Conn) {
@@ -69,6 +102,9 @@ func removeConnection(userId string, conn *websocket.Conn) {
 	conns := hub.clients[userId]
 	for i, ws := range conns {
 		if ws.Conn == conn {
+			if session := ws.session(); session != nil {
+				session.detach(ws)
+			}
 			conns = append(conns[:i], conns[i+1:]...)
 			break
 		}
@@ -78,10 +114,13 @@ func removeConnection(userId string, conn *websocket.Conn) {
 		delete(hub.clients, userId)
 		hub.lock.Unlock()
 
+		devices.sync(userId)
 		scheduleDisconnectBroadcast(userId)
 	} else {
 		hub.clients[userId] = conns
 		hub.lock.Unlock()
+
+		devices.sync(userId)
 	}
 }
 
@@ -98,37 +137,68 @@ func scheduleDisconnectBroadcast(userId string) {
 		delete(disconnectTimers.timers, userId)
 		disconnectTimers.Unlock()
 
-		hub.lock.Lock()
-		_, stillConnected := hub.clients[userId]
-		storedStatus := hub.status[userId]
-		if !stillConnected {
-			delete(hub.status, userId)
-		}
-		hub.lock.Unlock()
-
-		if !stillConnected && storedStatus != StatusInvisible {
-			go broadcastStatusUpdate(userId, StatusOffline)
-		}
+		finishDisconnect(userId)
 	})
 }
 
-func handleWebSocketMessages(userId string, conn *websocket.Conn) {
+// finishDisconnect announces the user offline unless they reconnected here or
+// are still connected through another node.
+func finishDisconnect(userId string) {
+	hub.lock.RLock()
+	_, stillConnected := hub.clients[userId]
+	hub.lock.RUnlock()
+	if stillConnected {
+		return
+	}
+	announceOffline(userId)
+}
+
+// announceOffline drops this node's presence for the user and broadcasts
+// offline unless another node still holds a connection for them.
+func announceOffline(userId string) {
+	if liveElsewhere := presence.clearLive(userId); liveElsewhere {
+		return
+	}
+	presence.clearActivities(userId)
+	if presence.chosenStatus(userId) != StatusInvisible {
+		broadcastStatusUpdate(userId, StatusOffline)
+	}
+}
+
+func handleWebSocketMessages(userId string, ws *WSConnection) {
+	conn := ws.Conn
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
 			removeConnection(userId, conn)
+			ws.close()
 			conn.Close()
 			return
 		}
 
 		var event EventMessage
-		if err := json.Unmarshal(message, &event); err != nil {
+		decodeErr := ws.codec.decode(message, &event)
+		if decodeErr == nil {
+			inspector.observe(inspectDirectionInbound, event.EventType, event.Payload, []string{userId})
+		}
+		if !checkRateLimit(ws, userId, event.EventType) {
+			continue
+		}
+		if decodeErr != nil || event.EventType == "" {
+			sendError(ws, event, errorMalformedFrame, errors.New("frame is not an event"))
 			continue
 		}
 
-		if handler, exists := eventHandlers[event.EventType]; exists {
-			handler(conn, event, userId)
+		spec, exists := eventCatalog[event.EventType]
+		if !exists {
+			sendError(ws, event, errorUnknownEvent, fmt.Errorf("unknown event type %s", event.EventType))
+			continue
+		}
+		if err := spec.validate(&event); err != nil {
+			sendError(ws, event, errorInvalidPayload, err)
+			continue
 		}
+		spec.handler(conn, event, userId)
 	}
 }
 
@@ -142,15 +212,28 @@ func marshalResponse(eventType string, payload interface{}) ([]byte, error) {
 	})
 }
 
-func writeToConn(ws *WSConnection, eventType string, payload interface{}) {
+func writeToConn(ws *WSConnection, eventType string, payload interface{}) error {
+	if session := ws.session(); session != nil {
+		return session.send(eventType, payload)
+	}
+
 	response, err := marshalResponse(eventType, payload)
 	if err != nil {
 		fmt.Println("Error marshalling response:", err)
-		return
+		return err
 	}
-	ws.Mutex.Lock()
-	defer ws.Mutex.Unlock()
-	ws.Conn.WriteMessage(websocket.TextMessage, response)
+	return ws.enqueue(response)
+}
+
+func findConnection(userId string, conn *websocket.Conn) *WSConnection {
+	hub.lock.RLock()
+	defer hub.lock.RUnlock()
+	for _, c := range hub.clients[userId] {
+		if c.Conn == conn {
+			return c
+		}
+	}
+	return nil
 }
 
 func sendResponse(conn *websocket.Conn, eventType string, payload interface{}) {
@@ -176,56 +259,29 @@ func sendResponse(conn *websocket.Conn, eventType string, payload interface{}) {
 }
 
 func broadcastStatusUpdate(userId string, status UserStatus) {
-	hub.lock.RLock()
-	snapshot := make(map[string][]*WSConnection, len(hub.clients))
-	for uid, conns := range hub.clients {
-		snapshot[uid] = conns
-	}
-	hub.lock.RUnlock()
+	broadcastStatusResponse(presence.describe(userId, status))
+}
 
-	guilds, err := fetchGuildMemberships(userId)
+func broadcastStatusResponse(response UserStatusResponse) {
+	peers, err := guildPeers(response.UserId)
 	if err != nil {
 		fmt.Println("Error fetching guild memberships:", err)
 		return
 	}
 
-	resp := UserStatusResponse{UserId: userId, Status: status}
-	notified := make(map[string]struct{})
-
-	for _, members := range guilds {
-		for _, targetUserId := range members {
-			if targetUserId == userId {
-				continue
-			}
-			if _, done := notified[targetUserId]; done {
-				continue
-			}
-			if conns, ok := snapshot[targetUserId]; ok {
-				for _, c := range conns {
-					sendResponse(c.Conn, "UPDATE_USER_STATUS", resp)
-				}
-				notified[targetUserId] = struct{}{}
-			}
-		}
-	}
+	presence.publish(response)
+	deliverToUsers("UPDATE_USER_STATUS", response, peers)
 }
 
-func EmitToGuild(eventType string, payload interface{}, key string, userId string) {
-	hub.lock.RLock()
-	snapshot := make(map[string][]*WSConnection, len(hub.clients))
-	for uid, conns := range hub.clients {
-		snapshot[uid] = conns
-	}
-	hub.lock.RUnlock()
-
+// guildPeers returns every user sharing at least one guild with userId.
+func guildPeers(userId string) ([]string, error) {
 	guilds, err := fetchGuildMemberships(userId)
 	if err != nil {
-		fmt.Println("Error fetching guild memberships:", err)
-		return
+		return nil, err
 	}
 
 	notified := make(map[string]struct{})
-
+	var peers []string
 	for _, members := range guilds {
 		for _, targetUserId := range members {
 			if targetUserId == userId {
@@ -234,12 +290,9 @@ func EmitToGuild(eventType string, payload interface{}, key string, userId strin
 			if _, done := notified[targetUserId]; done {
 				continue
 			}
-			if conns, ok := snapshot[targetUserId]; ok {
-				for _, c := range conns {
-					sendResponse(c.Conn, eventType, payload)
-				}
-				notified[targetUserId] = struct{}{}
-			}
+			notified[targetUserId] = struct{}{}
+			peers = append(peers, targetUserId)
 		}
 	}
+	return peers, nil
 }
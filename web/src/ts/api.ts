@@ -250,6 +250,30 @@ class ApiClient {
     this.authCookie = data.token;
     return encodeURIComponent(this.authCookie);
   }
+  async getSocketTicket(socketUrl: string): Promise<string | null> {
+    await this.getAuthCookie();
+    if (!this.authCookie) {
+      return null;
+    }
+    const url = new URL(socketUrl);
+    url.protocol = url.protocol === "wss:" ? "https:" : "http:";
+    url.pathname = url.pathname.replace(/\/(video-)?ws$/, "/ws-ticket");
+    try {
+      const response = await fetch(url.toString(), {
+        method: "POST",
+        headers: { Authorization: `Bearer ${this.authCookie}` }
+      });
+      if (!response.ok) {
+        console.error("Failed to retrieve ticket for ws");
+        return null;
+      }
+      const data = await response.json();
+      return data.ticket;
+    } catch (err) {
+      console.error("Failed to retrieve ticket for ws", err);
+      return null;
+    }
+  }
   getAuthToken = (): string | null => {
     return localStorage.getItem("jwt_token");
   };
@@ -72,9 +72,15 @@ import {
 } from "./types/interfaces.ts";
 import { appState } from "./appState.ts";
 import { userStatus } from "./status.ts";
+import { alertUser } from "./popups.ui.ts";
 
 export const typingStatusMap = new Map<string, Set<string>>();
 
+const GATEWAY_PROTOCOL_VERSION = 1;
+const CLOSE_UNSUPPORTED_PROTOCOL = 4014;
+const MAX_STATUS_QUERY_IDS = 100;
+const POPUP_SUBJECT_UPDATE_REQUIRED = "Update required";
+
 export const SocketEvent = Object.freeze({
   CREATE_CHANNEL: "CREATE_CHANNEL",
   JOIN_GUILD: "JOIN_GUILD",
@@ -139,10 +145,12 @@ export abstract class WebSocketClientBase {
   protected abstract handleEvent(message: any): void;
 
   protected async connectSocket(): Promise<void> {
-    const cookie = await apiClient.getAuthCookie();
-    if (cookie !== "undefined") {
+    const ticket = await apiClient.getSocketTicket(this.socketUrl);
+    if (ticket) {
       try {
-        this.socket = new WebSocket(this.socketUrl, [`cookie-${cookie}`]);
+        const url = new URL(this.socketUrl);
+        url.searchParams.set("v", String(GATEWAY_PROTOCOL_VERSION));
+        this.socket = new WebSocket(url.toString(), [`ticket-${ticket}`]);
         this.attachHandlers();
       } catch (err) {
         console.error("WebSocket connection failed", err);
@@ -167,6 +175,14 @@ export abstract class WebSocketClientBase {
     };
 
     this.socket.onclose = (event: CloseEvent) => {
+      if (event.code === CLOSE_UNSUPPORTED_PROTOCOL) {
+        alertUser(
+          POPUP_SUBJECT_UPDATE_REQUIRED,
+          "This version of LiventCord is no longer supported, reload the page to update."
+        );
+        this.onClose();
+        return;
+      }
       if (!event.wasClean) {
         const retryDelay = Math.min(
           Math.pow(2, this.retryCount) * 1000,
@@ -265,6 +281,10 @@ export class WebSocketClient extends WebSocketClientBase {
 
   protected handleEvent(message: any) {
     const { event_type, payload } = message;
+    if (event_type === "ERROR" && !this.eventHandlers[event_type]) {
+      console.warn("Gateway rejected event:", payload);
+      return;
+    }
     if (payload && typeof payload === "object") {
       if (payload.user_id) {
         this.userStatusCache.set(payload.user_id, {
@@ -345,7 +365,11 @@ export class WebSocketClient extends WebSocketClientBase {
         ids.forEach((id) => this.batchedUserIds.add(id));
         return;
       }
-      this.send(SocketEvent.GET_USER_STATUS, { user_ids: ids });
+      for (let i = 0; i < ids.length; i += MAX_STATUS_QUERY_IDS) {
+        this.send(SocketEvent.GET_USER_STATUS, {
+          user_ids: ids.slice(i, i + MAX_STATUS_QUERY_IDS)
+        });
+      }
     };
     if (this.isSocketOpen()) {
       sendRequest();